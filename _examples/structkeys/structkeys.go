@@ -30,7 +30,14 @@ func (mk *MyKey) UnmarshalBinary(data []byte) error {
 	return err
 }
 
-func (*MyKey) Less(a []byte, b []byte) bool {
+// MyKeyComparator orders the keys of the table by symbol, and then by time
+type MyKeyComparator struct{}
+
+func (MyKeyComparator) Name() string {
+	return "structkeys.MyKey"
+}
+
+func (MyKeyComparator) Compare(a []byte, b []byte) int {
 	_a := MyKey{}
 	_b := MyKey{}
 
@@ -39,9 +46,15 @@ func (*MyKey) Less(a []byte, b []byte) bool {
 
 	c := strings.Compare(_a.Symbol, _b.Symbol)
 	if c == 0 {
-		return _a.At.Before(_b.At)
+		switch {
+		case _a.At.Before(_b.At):
+			return -1
+		case _b.At.Before(_a.At):
+			return 1
+		}
+		return bytes.Compare(a, b)
 	}
-	return c < 0
+	return c
 }
 
 func main() {
@@ -49,7 +62,8 @@ func main() {
 	path := "test/structkeys"
 
 	keydb.Remove(path)
-	db, err := keydb.Open(path, true)
+	options := keydb.Options{CreateIfNeeded: true, Comparators: map[string]keydb.Comparator{"main": MyKeyComparator{}}}
+	db, err := keydb.OpenWithOptions(path, options)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,150 @@
+package keydb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// the block cache holds decoded key blocks, so that the blocks used by Get and to position Lookup iterators are not
+// read and decoded again. a single cache is shared by all of the segments of the database, and when it is full the
+// least recently used blocks are evicted. every block is charged the memory used by its decoded entries, which is
+// larger than its size on disk. the entries of a cached block are shared, so they must not be modified
+
+// CacheStats holds the statistics of the block cache, see Database.CacheStats
+type CacheStats struct {
+	// Hits is the number of block reads satisfied by the cache
+	Hits uint64
+	// Misses is the number of block reads that were not in the cache
+	Misses uint64
+	// Blocks is the number of blocks in the cache
+	Blocks int
+	// Size is the number of bytes of decoded blocks in the cache
+	Size int64
+	// Capacity is the maximum size of the cache, zero if the cache is disabled
+	Capacity int64
+}
+
+type blockCache struct {
+	sync.Mutex
+	capacity int64
+	size     int64
+	blocks   map[blockCacheKey]*list.Element
+	// the most recently used block is at the front
+	lru    *list.List
+	hits   uint64
+	misses uint64
+}
+
+type blockCacheKey struct {
+	segment uint64
+	block   int64
+}
+
+type cachedBlock struct {
+	key     blockCacheKey
+	entries []blockEntry
+	size    int64
+}
+
+// blockEntrySize is the memory used by a decoded entry, not including its key
+const blockEntrySize = int64(unsafe.Sizeof(blockEntry{}))
+
+// entriesSize returns the memory used by the decoded entries of a block
+func entriesSize(entries []blockEntry) int64 {
+	size := int64(cap(entries)) * blockEntrySize
+	for _, entry := range entries {
+		size += int64(cap(entry.key))
+	}
+	return size
+}
+
+// every disk segment has a unique id in the cache. the segment id can not be used, since a database created before
+// the manifest reused the segment ids after every open, and keeps the ids of those segment files
+var nextCacheID uint64
+
+func newCacheID() uint64 {
+	return atomic.AddUint64(&nextCacheID, 1)
+}
+
+// newBlockCache returns a cache holding up to capacity bytes of blocks, or nil if capacity is not positive
+func newBlockCache(capacity int64) *blockCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &blockCache{capacity: capacity, blocks: make(map[blockCacheKey]*list.Element), lru: list.New()}
+}
+
+// get returns the entries of a cached block. a nil cache holds no blocks
+func (c *blockCache) get(key blockCacheKey) ([]blockEntry, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	e, ok := c.blocks[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).entries, true
+}
+
+// put adds a block to the cache, evicting the least recently used blocks to make room for it
+func (c *blockCache) put(key blockCacheKey, entries []blockEntry, size int64) {
+	if c == nil || size > c.capacity {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.blocks[key]; ok {
+		// another reader loaded the block
+		return
+	}
+	for c.size+size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, entries: entries, size: size})
+	c.size += size
+}
+
+// removeSegment removes the blocks of a segment, it is called when the segment is closed
+func (c *blockCache) removeSegment(segment uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	for key, e := range c.blocks {
+		if key.segment == segment {
+			c.remove(e)
+		}
+	}
+}
+
+func (c *blockCache) remove(e *list.Element) {
+	block := c.lru.Remove(e).(*cachedBlock)
+	delete(c.blocks, block.key)
+	c.size -= block.size
+}
+
+// CacheStats returns the statistics of the block cache
+func (db *Database) CacheStats() CacheStats {
+	return db.options.cache.stats()
+}
+
+func (c *blockCache) stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.Lock()
+	defer c.Unlock()
+
+	return CacheStats{Hits: c.hits, Misses: c.misses, Blocks: len(c.blocks), Size: c.size, Capacity: c.capacity}
+}
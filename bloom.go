@@ -0,0 +1,121 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+)
+
+// a bloom filter for the keys of a disk segment, including removed keys, so that a Get for a key that is not in
+// the segment rarely needs to read a key block. the filter is written at the end of the data file as
+// bits []byte
+// probes byte
+// filterlen uint32 (length of bits and probes)
+// checksum uint32 (crc32c of bits and probes)
+//
+// the data file is only read using the offsets in the key file, so the filter does not affect reading values
+
+const bloomTrailerSize = 8
+
+// the length of the filter is recorded as a uint32, so a filter has at most maxBloomBits bits. a segment with more
+// than maxBloomBits / bitsPerKey keys has a higher false positive rate
+const maxBloomBits = (math.MaxUint32 - 1) * 8
+
+type bloomFilter []byte
+
+// newBloomFilter creates a filter from the key hashes, using bitsPerKey bits for each key
+func newBloomFilter(hashes []uint64, bitsPerKey int) bloomFilter {
+	bits := uint64(len(hashes)) * uint64(bitsPerKey)
+	if bits < 64 {
+		bits = 64
+	}
+	if bits > maxBloomBits {
+		bits = maxBloomBits
+	}
+	bytes := (bits + 7) / 8
+	bits = bytes * 8
+
+	// ln(2) * bitsPerKey minimizes the false positive rate
+	probes := bitsPerKey * 69 / 100
+	if probes < 1 {
+		probes = 1
+	}
+	if probes > 30 {
+		probes = 30
+	}
+
+	filter := make(bloomFilter, bytes+1)
+	for _, h := range hashes {
+		h1, h2 := h, h>>32|h<<32
+		for i := 0; i < probes; i++ {
+			bit := h1 % bits
+			filter[bit/8] |= 1 << (bit % 8)
+			h1 += h2
+		}
+	}
+	filter[bytes] = byte(probes)
+	return filter
+}
+
+func bloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// mayContain returns false if the key is definitely not in the segment
+func (filter bloomFilter) mayContain(key []byte) bool {
+	if len(filter) < 2 {
+		return true
+	}
+	bits := uint64(len(filter)-1) * 8
+	probes := int(filter[len(filter)-1])
+
+	h := bloomHash(key)
+	h1, h2 := h, h>>32|h<<32
+	for i := 0; i < probes; i++ {
+		bit := h1 % bits
+		if filter[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+		h1 += h2
+	}
+	return true
+}
+
+// encodeBloomTrailer returns the filter along with its length and checksum, as written to the end of the data file
+func encodeBloomTrailer(filter bloomFilter) []byte {
+	trailer := make([]byte, len(filter)+bloomTrailerSize)
+	copy(trailer, filter)
+	binary.LittleEndian.PutUint32(trailer[len(filter):], uint32(len(filter)))
+	binary.LittleEndian.PutUint32(trailer[len(filter)+4:], crc32.Checksum(filter, crcTable))
+	return trailer
+}
+
+// loadBloomFilter reads the filter from the end of the data file of a segment
+func loadBloomFilter(ds *diskSegment) (bloomFilter, error) {
+	length := ds.dataFile.Length()
+	if length < bloomTrailerSize {
+		return nil, &SegmentError{Filename: ds.dataFile.Name(), Err: SegmentCorrupted}
+	}
+	var trailer [bloomTrailerSize]byte
+	_, err := ds.dataFile.ReadAt(trailer[:], length-bloomTrailerSize)
+	if err != nil {
+		return nil, err
+	}
+	filterlen := int64(binary.LittleEndian.Uint32(trailer[:]))
+	if filterlen > length-bloomTrailerSize {
+		return nil, &SegmentError{Filename: ds.dataFile.Name(), Err: SegmentCorrupted}
+	}
+	offset := length - bloomTrailerSize - filterlen
+	filter := make(bloomFilter, filterlen)
+	_, err = ds.dataFile.ReadAt(filter, offset)
+	if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(filter, crcTable) != binary.LittleEndian.Uint32(trailer[4:]) {
+		return nil, &ErrCorruption{Filename: ds.dataFile.Name(), Offset: offset}
+	}
+	return filter, nil
+}
@@ -2,15 +2,14 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/robaho/keydb"
 	"html"
-	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
 )
 
 // dump a database to stdout
@@ -18,6 +17,13 @@ func main() {
 	path := flag.String("path", "", "set the database path")
 	out := flag.String("out", "dbdump.xml", "set output file")
 
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintln(w, "usage: dbdump -path dbpath [-out file]")
+		fmt.Fprintln(w, "the database is opened with the default options, so a database with a table that uses a custom")
+		fmt.Fprintln(w, "Comparator, or with segments written by a custom Compressor, can not be dumped")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
 
 	dbpath := filepath.Clean(*path)
@@ -39,15 +45,21 @@ func main() {
 		log.Fatalln("path is not a directory")
 	}
 
-	tables := findTableNames(dbpath)
-	if tables == nil || len(tables) == 0 {
-		log.Fatal("database contains zero tables")
+	db, err := keydb.Open(dbpath, false)
+	if errors.Is(err, keydb.ComparatorMismatch) || errors.Is(err, keydb.UnknownCompressor) {
+		log.Fatal(err, "\ndbdump only supports the default comparator and the built in compressors")
+	}
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	db, err := keydb.Open(dbpath, false)
+	tables, err := db.Tables()
 	if err != nil {
 		log.Fatal(err)
 	}
+	if len(tables) == 0 {
+		log.Fatal("database contains zero tables")
+	}
 
 	fmt.Fprintf(w, "<db path=\"%s\">\n", html.EscapeString(dbpath))
 	for _, v := range tables {
@@ -82,25 +94,3 @@ func main() {
 		log.Fatal("unable to flush writer, io errors,", err)
 	}
 }
-
-func findTableNames(dbpath string) []string {
-	names := make(map[string]bool)
-
-	infos, err := ioutil.ReadDir(dbpath)
-	if err != nil {
-		log.Fatal("unable to read directory", err)
-	}
-
-	for _, fi := range infos {
-		if strings.Index(fi.Name(), ".keys.") >= 0 {
-			table := strings.Split(fi.Name(), ".")[0]
-			names[table] = true
-		}
-	}
-	var namesS []string
-	for k := range names {
-		namesS = append(namesS, k)
-
-	}
-	return namesS
-}
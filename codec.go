@@ -0,0 +1,107 @@
+package keydb
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Codec converts the keys or values of a TypedTable to and from bytes. a key codec must encode keys so that
+// their byte order is the order the table should use, or the table must have a matching Comparator
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// CodecError is returned by a TypedTable when a key or value cannot be encoded or decoded. Err is the error
+// returned by the codec
+type CodecError struct {
+	// Op is "encode" or "decode"
+	Op string
+	// Key is true if the error is for a key, rather than a value
+	Key bool
+	Err error
+}
+
+func (e *CodecError) Error() string {
+	what := "value"
+	if e.Key {
+		what = "key"
+	}
+	return "unable to " + e.Op + " " + what + ": " + e.Err.Error()
+}
+
+func (e *CodecError) Unwrap() error {
+	return e.Err
+}
+
+var errNotBinaryMarshaler = errors.New("type does not implement encoding.BinaryMarshaler")
+var errNotBinaryUnmarshaler = errors.New("pointer to type does not implement encoding.BinaryUnmarshaler")
+
+// BinaryCodec is a Codec for types that implement encoding.BinaryMarshaler, and whose pointer type implements
+// encoding.BinaryUnmarshaler
+type BinaryCodec[T any] struct{}
+
+func (BinaryCodec[T]) Encode(v T) ([]byte, error) {
+	m, ok := any(v).(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T", errNotBinaryMarshaler, v)
+	}
+	return m.MarshalBinary()
+}
+
+func (BinaryCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	u, ok := any(&v).(encoding.BinaryUnmarshaler)
+	if !ok {
+		return v, fmt.Errorf("%w: %T", errNotBinaryUnmarshaler, v)
+	}
+	err := u.UnmarshalBinary(data)
+	return v, err
+}
+
+// JSONCodec is a Codec that encodes values as JSON
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec is a Codec that encodes values using encoding/gob. every value is encoded with its type information,
+// so it is better suited to values than keys
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// StringCodec is a Codec for strings, which are stored as their bytes
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(data []byte) (string, error) {
+	return string(data), nil
+}
@@ -0,0 +1,41 @@
+package keydb
+
+import "bytes"
+
+// Comparator defines the order of the keys in a table. a table must always be read with the comparator it was written
+// with, so the name of the comparator is recorded in the manifest, and opening the database with a different
+// comparator for the table fails with ComparatorMismatch. Compare must only return 0 for identical keys
+type Comparator interface {
+	// Name identifies the order of the keys
+	Name() string
+	// Compare returns a negative number if a is before b, 0 if they are equal, and a positive number if a is after b
+	Compare(a, b []byte) int
+}
+
+// BytewiseComparator orders keys by their bytes, it is the comparator of a table unless one is set using the
+// Comparators option
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Name() string {
+	return "keydb.BytewiseComparator"
+}
+
+func (bytewiseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// less and equal compare keys using a comparator, a nil comparator is bytewise
+func less(c Comparator, a []byte, b []byte) bool {
+	if c == nil {
+		return bytes.Compare(a, b) < 0
+	}
+	return c.Compare(a, b) < 0
+}
+func equal(c Comparator, a []byte, b []byte) bool {
+	if c == nil {
+		return bytes.Equal(a, b)
+	}
+	return c.Compare(a, b) == 0
+}
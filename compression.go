@@ -0,0 +1,292 @@
+package keydb
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// the segments of a table with a Compressor are written with compressed blocks. each key block is compressed
+// individually, and the values are split into blocks of dataBlockSize bytes, which are compressed individually, so
+// that reading a value only decompresses the blocks that hold it. the data offsets in the key blocks, and the
+// checksums, are those of the uncompressed blocks and values. the key file ends with the block index
+//
+// keyBlockOffsets [keyBlocks+1]uint64, the offsets of the compressed key blocks in the key file
+// dataBlockOffsets [dataBlocks+1]uint64, the offsets of the compressed data blocks in the data file
+// keyBlocks uint32
+// dataBlocks uint32
+// dataLength uint64, the length of the uncompressed values
+// checksum uint32, the crc32c of the offsets
+//
+// in version 4 segments the block index is followed by the footer. the bloom filter follows the last data block, and
+// is not compressed. the name of the compressor is recorded for every segment in the manifest, and in the header of
+// version 4 segments, so the segments of a table can use different compressors, and opening the database fails with
+// UnknownCompressor if a segment uses a compressor that is not available
+
+const dataBlockSize = 16384
+const blockIndexTrailerSize = 20
+
+// Compressor compresses the blocks of a segment
+type Compressor interface {
+	// Name identifies the compressed format, it is recorded for every segment
+	Name() string
+	// Compress appends the compressed src to dst
+	Compress(dst []byte, src []byte) ([]byte, error)
+	// Decompress decompresses src into dst, which is the length of the uncompressed data
+	Decompress(dst []byte, src []byte) error
+}
+
+// FlateCompressor compresses blocks using compress/flate, with the default compression level
+var FlateCompressor = NewFlateCompressor(flate.DefaultCompression)
+
+// NewFlateCompressor returns a Compressor using compress/flate with a compression level, see flate.NewWriter.
+// the level does not change the name of the compressor, since any level can be decompressed
+func NewFlateCompressor(level int) Compressor {
+	return flateCompressor{level: level}
+}
+
+type flateCompressor struct {
+	level int
+}
+
+func (flateCompressor) Name() string {
+	return "flate"
+}
+
+func (c flateCompressor) Compress(dst []byte, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	w, err := flate.NewWriter(buf, c.level)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCompressor) Decompress(dst []byte, src []byte) error {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	_, err := io.ReadFull(r, dst)
+	return err
+}
+
+// compressorNamed returns the compressor with the name, from the Compressors option or the built in compressors,
+// nil if there is none
+func (o Options) compressorNamed(name string) Compressor {
+	for _, c := range o.Compressors {
+		if c != nil && c.Name() == name {
+			return c
+		}
+	}
+	if name == FlateCompressor.Name() {
+		return FlateCompressor
+	}
+	return nil
+}
+
+// blockWriter writes the blocks of a segment file, compressing them if the segment has a compressor, and records
+// the offsets of the compressed blocks
+type blockWriter struct {
+	w          *bufio.Writer
+	compressor Compressor
+	offset     int64
+	offsets    []int64
+	buffer     []byte
+}
+
+func (bw *blockWriter) write(block []byte) error {
+	if bw.compressor == nil {
+		_, err := bw.w.Write(block)
+		return err
+	}
+	var err error
+	bw.buffer, err = bw.compressor.Compress(bw.buffer[:0], block)
+	if err != nil {
+		return err
+	}
+	bw.offsets = append(bw.offsets, bw.offset)
+	n, err := bw.w.Write(bw.buffer)
+	bw.offset += int64(n)
+	return err
+}
+
+// valueWriter writes the values of a segment to the data file, in blocks of dataBlockSize bytes if the segment
+// is compressed
+type valueWriter struct {
+	blockWriter
+	pending []byte
+	length  int64
+}
+
+func (vw *valueWriter) write(p []byte) error {
+	vw.length += int64(len(p))
+	if vw.compressor == nil {
+		_, err := vw.w.Write(p)
+		return err
+	}
+	for len(p) > 0 {
+		n := dataBlockSize - len(vw.pending)
+		if n > len(p) {
+			n = len(p)
+		}
+		vw.pending = append(vw.pending, p[:n]...)
+		p = p[n:]
+		if len(vw.pending) == dataBlockSize {
+			err := vw.blockWriter.write(vw.pending)
+			if err != nil {
+				return err
+			}
+			vw.pending = vw.pending[:0]
+		}
+	}
+	return nil
+}
+
+// finish writes the last partial block
+func (vw *valueWriter) finish() error {
+	if len(vw.pending) == 0 {
+		return nil
+	}
+	err := vw.blockWriter.write(vw.pending)
+	vw.pending = vw.pending[:0]
+	return err
+}
+
+// encodeBlockIndex returns the block index written to the end of the key file of a compressed segment
+func encodeBlockIndex(keys *blockWriter, values *valueWriter) []byte {
+	keyOffsets := append(keys.offsets, keys.offset)
+	dataOffsets := append(values.offsets, values.offset)
+
+	index := make([]byte, 0, (len(keyOffsets)+len(dataOffsets))*8+blockIndexTrailerSize)
+	for _, offset := range append(keyOffsets, dataOffsets...) {
+		index = binary.LittleEndian.AppendUint64(index, uint64(offset))
+	}
+	checksum := crc32.Checksum(index, crcTable)
+	index = binary.LittleEndian.AppendUint32(index, uint32(len(keyOffsets)-1))
+	index = binary.LittleEndian.AppendUint32(index, uint32(len(dataOffsets)-1))
+	index = binary.LittleEndian.AppendUint64(index, uint64(values.length))
+	return binary.LittleEndian.AppendUint32(index, checksum)
+}
+
+// loadBlockIndex reads the block index of a compressed segment, which ends at length in the key file
+func loadBlockIndex(ds *diskSegment, length int64) error {
+	corrupted := &SegmentError{Filename: ds.keyFile.Name(), Err: SegmentCorrupted}
+
+	if length < blockIndexTrailerSize {
+		return corrupted
+	}
+	var trailer [blockIndexTrailerSize]byte
+	_, err := ds.keyFile.ReadAt(trailer[:], length-blockIndexTrailerSize)
+	if err != nil {
+		return err
+	}
+	keyBlocks := int64(binary.LittleEndian.Uint32(trailer[0:]))
+	dataBlocks := int64(binary.LittleEndian.Uint32(trailer[4:]))
+	dataLength := int64(binary.LittleEndian.Uint64(trailer[8:]))
+	checksum := binary.LittleEndian.Uint32(trailer[16:])
+
+	indexLen := (keyBlocks + 1 + dataBlocks + 1) * 8
+	if keyBlocks == 0 || indexLen > length-blockIndexTrailerSize {
+		return corrupted
+	}
+	offset := length - blockIndexTrailerSize - indexLen
+	index := make([]byte, indexLen)
+	_, err = ds.keyFile.ReadAt(index, offset)
+	if err != nil {
+		return err
+	}
+	if crc32.Checksum(index, crcTable) != checksum {
+		return &ErrCorruption{Filename: ds.keyFile.Name(), Offset: offset}
+	}
+
+	offsets := make([]int64, keyBlocks+1+dataBlocks+1)
+	for i := range offsets {
+		offsets[i] = int64(binary.LittleEndian.Uint64(index[i*8:]))
+		if i > 0 && i != int(keyBlocks)+1 && offsets[i] < offsets[i-1] {
+			return corrupted
+		}
+	}
+	ds.keyOffsets = offsets[:keyBlocks+1]
+	ds.dataOffsets = offsets[keyBlocks+1:]
+	ds.dataLength = dataLength
+	if ds.keyOffsets[keyBlocks] != offset || ds.dataOffsets[dataBlocks] > ds.dataFile.Length() ||
+		(dataLength+dataBlockSize-1)/dataBlockSize != dataBlocks {
+		return corrupted
+	}
+	ds.keyBlocks = keyBlocks
+	return nil
+}
+
+// readCompressed decompresses a block of a compressed segment file into dst
+func readCompressed(file *memoryMappedFile, compressor Compressor, offsets []int64, block int64, dst []byte) error {
+	if block < 0 || block >= int64(len(offsets)-1) {
+		return &SegmentError{Filename: file.Name(), Err: SegmentCorrupted}
+	}
+	src := make([]byte, offsets[block+1]-offsets[block])
+	_, err := file.ReadAt(src, offsets[block])
+	if err != nil {
+		return err
+	}
+	err = compressor.Decompress(dst, src)
+	if err != nil {
+		return &SegmentError{Filename: file.Name(), Err: SegmentCorrupted}
+	}
+	return nil
+}
+
+// readValues reads from the values in the data file of a segment, decompressing them if the segment is compressed
+func (ds *diskSegment) readValues(buffer []byte, offset int64) error {
+	if ds.format.compressor == nil {
+		_, err := ds.dataFile.ReadAt(buffer, offset)
+		return err
+	}
+	if offset+int64(len(buffer)) > ds.dataLength {
+		return &SegmentError{Filename: ds.dataFile.Name(), Err: SegmentCorrupted}
+	}
+	for len(buffer) > 0 {
+		index := offset / dataBlockSize
+		block, err := ds.readDataBlock(index)
+		if err != nil {
+			return err
+		}
+		n := copy(buffer, block[offset-index*dataBlockSize:])
+		buffer = buffer[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+// dataBlock is a decompressed data block. it is shared by the readers of the segment, so it must not be modified
+type dataBlock struct {
+	index int64
+	data  []byte
+}
+
+// readDataBlock returns a decompressed data block. the segment keeps the last block read, so that reading the values
+// of a block in order, as a scan does, only decompresses the block once
+func (ds *diskSegment) readDataBlock(index int64) ([]byte, error) {
+	if last := ds.lastDataBlock.Load(); last != nil && last.index == index {
+		return last.data, nil
+	}
+	size := ds.dataLength - index*dataBlockSize
+	if size > dataBlockSize {
+		size = dataBlockSize
+	}
+	data := make([]byte, size)
+	err := readCompressed(ds.dataFile, ds.format.compressor, ds.dataOffsets, index, data)
+	if err != nil {
+		return nil, err
+	}
+	ds.lastDataBlock.Store(&dataBlock{index: index, data: data})
+	return data, nil
+}
@@ -1,12 +1,12 @@
 package keydb
 
 import (
-	"bytes"
 	"github.com/nightlyone/lockfile"
 	"io/ioutil"
 	"os"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 )
@@ -18,10 +18,14 @@ type Database struct {
 	open         bool
 	closing      bool
 	transactions map[uint64]*Transaction
+	snapshots    int
 	path         string
 	wg           sync.WaitGroup
 	nextSegID    uint64
 	lockfile     lockfile.Lockfile
+	log          *writeAheadLog
+	manifest     *manifest
+	options      Options
 
 	// if non-nil an asynchronous error has occurred, and the database cannot be used
 	err error
@@ -29,15 +33,26 @@ type Database struct {
 
 type internalTable struct {
 	sync.Mutex
+	// held by the merger while it merges the table's segments
+	mergeLock    sync.Mutex
 	segments     []segment
 	transactions int
 	name         string
+
+	// the number of commits to the table, and the commits that open serializable transactions must be checked
+	// against, see serializable.go
+	commitSeq    uint64
+	recent       []recentCommit
+	serializable map[uint64]uint64
 }
 
 // LookupIterator iterator interface for table scanning. all iterators should be read until completion
 type LookupIterator interface {
 	// returns EndOfIterator when complete, if err is nil, then key and value are valid
 	Next() (key []byte, value []byte, err error)
+	// Seek repositions the iterator so that Next returns the first key in range that is >= key, or for an iterator
+	// from LookupReverse the last key in range that is <= key. a nil key repositions to the start of the range
+	Seek(key []byte) error
 	// returns the next non-deleted key in the index
 	peekKey() ([]byte, error)
 }
@@ -47,20 +62,33 @@ var global_lock sync.RWMutex
 // Open a database. The database can only be opened by a single process, but the *Database
 // reference can be shared across Go routines. The path is a directory name.
 // if createIfNeeded is true, them if the db doesn't exist it will be created
-// Additional tables can be added on subsequent opens, but there is no current way to delete a table,
-// except for deleting the table related files from the directory
+// Tables are created by the first commit to them, and can be removed using DropTable
 func Open(path string, createIfNeeded bool) (*Database, error) {
+	return OpenWithOptions(path, Options{CreateIfNeeded: createIfNeeded})
+}
+
+// OpenWithOptions opens a database using the provided options, see Open. An error is returned if the
+// options are not valid.
+func OpenWithOptions(path string, options Options) (*Database, error) {
+	options = options.withDefaults()
+	err := options.validate()
+	if err != nil {
+		return nil, err
+	}
+
 	global_lock.Lock()
 	defer global_lock.Unlock()
 
-	db, err := open(path)
-	if err == NoDatabaseFound && createIfNeeded == true {
-		return create(path)
+	options.cache = newBlockCache(options.BlockCacheSize)
+
+	db, err := open(path, options)
+	if err == NoDatabaseFound && options.CreateIfNeeded == true {
+		return create(path, options)
 	}
 	return db, err
 }
 
-func open(path string) (*Database, error) {
+func open(path string, options Options) (*Database, error) {
 
 	path = filepath.Clean(path)
 
@@ -82,18 +110,113 @@ func open(path string) (*Database, error) {
 		return nil, DatabaseInUse
 	}
 
-	db := &Database{path: path, open: true}
+	db := &Database{path: path, open: true, options: options}
 	db.lockfile = lf
 	db.transactions = make(map[uint64]*Transaction)
 	db.tables = make(map[string]*internalTable)
 
+	m, err := readManifest(path)
+	if err != nil {
+		lf.Unlock()
+		return nil, err
+	}
+	db.manifest = m
+	db.nextSegID = m.NextSegmentID
+
+	err = errn(m.checkComparators(options), m.checkCompressors(options))
+	if err != nil {
+		lf.Unlock()
+		return nil, err
+	}
+
+	err = recoverFiles(path, m, options)
+	if err != nil {
+		lf.Unlock()
+		return nil, err
+	}
+
+	log, records, err := openLog(filepath.Join(path, logFilename), options)
+	if err != nil {
+		lf.Unlock()
+		return nil, err
+	}
+	db.log = log
+
+	// commits that were logged but not written to disk before the last close are replayed
+	// as memory segments, so they are visible to the first transaction. the commits and table records at or
+	// below the sequence numbers in the manifest are already applied. a table record discards
+	// the commits to the table before it, as they were on disk when the record was logged
+	if m.LogSequence > log.seq {
+		log.seq = m.LogSequence
+	}
+	if m.TableSequence > log.seq {
+		log.seq = m.TableSequence
+	}
+	replay := make(map[string][]segment)
+	discarded := make(map[segment]bool)
+	var commits []logRecord
+	for _, record := range records {
+		if record.recordType == logCommit {
+			if record.seq <= m.LogSequence {
+				continue
+			}
+			for _, lt := range record.tables {
+				replay[lt.table] = append(replay[lt.table], lt.memory)
+			}
+			commits = append(commits, record)
+			continue
+		}
+		if record.seq <= m.TableSequence {
+			continue
+		}
+		for _, s := range replay[record.table] {
+			discarded[s] = true
+		}
+		delete(replay, record.table)
+
+		err = replayTableRecord(path, m, record)
+		if err != nil {
+			log.close()
+			lf.Unlock()
+			return nil, err
+		}
+	}
+	for name, segments := range replay {
+		table, err := db.getTable(name)
+		if err != nil {
+			db.closeSegments()
+			log.close()
+			lf.Unlock()
+			return nil, err
+		}
+		table.segments = append(table.segments, segments...)
+	}
+	// every replayed commit is pending before any is written, so the log is not truncated while it holds one
+	pending := commits[:0]
+	for _, record := range commits {
+		var tables []logTable
+		for _, lt := range record.tables {
+			if !discarded[lt.memory] {
+				tables = append(tables, lt)
+			}
+		}
+		if len(tables) > 0 {
+			record.tables = tables
+			db.log.replayed(record)
+			pending = append(pending, record)
+		}
+	}
+	for _, record := range pending {
+		writeSegmentsToDiskAsync(db, record.seq, record.tables)
+	}
+
 	db.wg.Add(1)
 	go mergeDiskSegments(db)
 
 	return db, nil
 }
 
-func create(path string) (*Database, error) {
+func create(path string, options Options) (*Database, error) {
 	path = filepath.Clean(path)
 
 	err := os.MkdirAll(path, os.ModePerm)
@@ -101,7 +224,7 @@ func create(path string) (*Database, error) {
 		return nil, err
 	}
 
-	return open(path)
+	return open(path, options)
 }
 
 // Remove the database, deleting all files. the caller must be able to
@@ -150,13 +273,13 @@ func IsValidDatabase(path string) error {
 	}
 
 	for _, f := range infos {
-		if "lockfile" == f.Name() {
+		if "lockfile" == f.Name() || logFilename == f.Name() || logFilename+".tmp" == f.Name() || strings.HasPrefix(f.Name(), manifestFilename) {
 			continue
 		}
-		if f.Name() == filepath.Base(path) {
+		if f.Name() == filepath.Base(path) || (quarantineDir == f.Name() && f.IsDir()) {
 			continue
 		}
-		if matched, _ := regexp.Match(".*\\.(keys|data)\\..*", []byte(f.Name())); !matched {
+		if !segmentFileRegexp.MatchString(f.Name()) {
 			return NotValidDatabase
 		}
 	}
@@ -164,14 +287,14 @@ func IsValidDatabase(path string) error {
 }
 
 // Close the database. any memory segments are persisted to disk.
-// The resulting segments are merged until the default maxSegments is reached
+// The resulting segments are merged until the MaxSegments option is reached
 func (db *Database) Close() error {
 	global_lock.Lock()
 	defer global_lock.Unlock()
 	if !db.open {
 		return DatabaseClosed
 	}
-	if len(db.transactions) > 0 {
+	if len(db.transactions) > 0 || db.snapshots > 0 {
 		return DatabaseHasOpenTransactions
 	}
 
@@ -181,13 +304,11 @@ func (db *Database) Close() error {
 
 	db.wg.Wait()
 
-	err := mergeDiskSegments0(db, maxSegments)
+	err := mergeDiskSegments0(db, db.options.MaxSegments)
 
-	for _, table := range db.tables {
-		for _, segment := range table.segments {
-			segment.Close()
-		}
-	}
+	db.closeSegments()
+
+	err = errn(err, db.log.close())
 
 	db.lockfile.Unlock()
 	db.open = false
@@ -206,7 +327,7 @@ func (db *Database) CloseWithMerge(segmentCount int) error {
 	if db.err != nil {
 		return db.err
 	}
-	if len(db.transactions) > 0 {
+	if len(db.transactions) > 0 || db.snapshots > 0 {
 		return DatabaseHasOpenTransactions
 	}
 
@@ -220,25 +341,57 @@ func (db *Database) CloseWithMerge(segmentCount int) error {
 		mergeDiskSegments0(db, segmentCount)
 	}
 
-	for _, table := range db.tables {
-		for _, segment := range table.segments {
-			segment.Close()
-		}
-	}
+	db.closeSegments()
+
+	err := db.log.close()
 
 	db.lockfile.Unlock()
 	db.open = false
 
-	return nil
+	return err
 }
 
-func (db *Database) nextSegmentID() uint64 {
-	return atomic.AddUint64(&db.nextSegID, 1)
+// getTable returns the internal table, loading the table's segments if this is the first use of
+// the table. the caller must hold the database lock
+func (db *Database) getTable(table string) (*internalTable, error) {
+	it, ok := db.tables[table]
+	if !ok {
+		segments, err := loadDiskSegments(db, table)
+		if err != nil {
+			return nil, err
+		}
+		it = &internalTable{name: table, segments: segments}
+		db.tables[table] = it
+	}
+	return it, nil
 }
 
-func less(a []byte, b []byte) bool {
-	return bytes.Compare(a, b) < 0
+// lockTables locks the tables in name order, so that transactions spanning several tables do not deadlock
+func lockTables(tables []*internalTable) {
+	sorted := make([]*internalTable, len(tables))
+	copy(sorted, tables)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].name < sorted[j].name
+	})
+	for _, table := range sorted {
+		table.Lock()
+	}
 }
-func equal(a []byte, b []byte) bool {
-	return bytes.Equal(a, b)
+
+func unlockTables(tables []*internalTable) {
+	for _, table := range tables {
+		table.Unlock()
+	}
+}
+
+func (db *Database) closeSegments() {
+	for _, table := range db.tables {
+		for _, segment := range table.segments {
+			segment.Close()
+		}
+	}
+}
+
+func (db *Database) nextSegmentID() uint64 {
+	return atomic.AddUint64(&db.nextSegID, 1) - 1
 }
@@ -2,8 +2,13 @@ package keydb_test
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -39,7 +44,7 @@ func TestDatabase(t *testing.T) {
 		t.Fatal("unable to get by key", err)
 	}
 
-	large := make([]byte, 1025)
+	large := make([]byte, keydb.MaxKeyLength+1)
 	err = tx.Put(large, []byte("myvalue"))
 	if err == nil {
 		t.Fatal("should not of been able to Put a large key")
@@ -72,12 +77,19 @@ func TestDatabase(t *testing.T) {
 		t.Fatal("should not of found removed key")
 	}
 	tx.Commit()
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
 }
 
 func TestCommit(t *testing.T) {
 	keydb.Remove("test/mydb")
 
 	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
 	tx, err := db.BeginTX("main")
 	if err != nil {
 		t.Fatal("unable to create transaction", err)
@@ -308,6 +320,11 @@ func TestSegmentMerge(t *testing.T) {
 	if count != 100 {
 		t.Fatal("incorrect count, should be 100, is ", count)
 	}
+	tx.Commit()
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
 }
 
 func countFiles(path string) int {
@@ -364,6 +381,71 @@ func TestPersistence(t *testing.T) {
 	}
 }
 
+func TestCorruptSegment(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for _, value := range []string{"old-value", "new-value"} {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte("mykey"), []byte(value))
+		err = tx.CommitSync()
+		if err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	err = db.CloseWithMerge(0)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// damage the value in the newest segment, the older value must not be returned in its place
+	files, _ := filepath.Glob("test/mydb/main.data.*")
+	newest, newestID := "", -1
+	for _, file := range files {
+		id, err := strconv.Atoi(file[strings.LastIndex(file, ".")+1:])
+		if err == nil && id > newestID {
+			newest, newestID = file, id
+		}
+	}
+	data, err := ioutil.ReadFile(newest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] ^= 0xFF
+	ioutil.WriteFile(newest, data, os.ModePerm)
+
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	defer db.Close()
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	defer tx.Rollback()
+
+	var ec *keydb.ErrCorruption
+	value, err := tx.Get([]byte("mykey"))
+	if !errors.As(err, &ec) || ec.Filename != newest {
+		t.Fatal("Get should fail checksum", string(value), err)
+	}
+	itr, err := tx.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal("unable to open iterator", err)
+	}
+	_, value, err = itr.Next()
+	if !errors.As(err, &ec) || ec.Filename != newest {
+		t.Fatal("Lookup should fail checksum", string(value), err)
+	}
+}
+
 func TestRemovedKeys(t *testing.T) {
 	keydb.Remove("test/mydb")
 
@@ -433,3 +515,995 @@ func TestRemovedKeys(t *testing.T) {
 	tx.Commit()
 	err = db.CloseWithMerge(1)
 }
+
+func TestOpenWithOptions(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	_, err := keydb.OpenWithOptions("test/mydb", keydb.Options{CreateIfNeeded: true, KeyBlockSize: 100})
+	if !errors.Is(err, keydb.InvalidOptions) {
+		t.Fatal("block size should be rejected", err)
+	}
+
+	db, err := keydb.OpenWithOptions("test/mydb", keydb.Options{CreateIfNeeded: true, KeyBlockSize: 8192, MaxSegments: 2})
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 10; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		for j := 0; j < 1000; j++ {
+			tx.Put([]byte(fmt.Sprint("mykey", i, ".", j)), []byte(fmt.Sprint("myvalue", j)))
+		}
+		err = tx.CommitSync()
+		if err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	if count := countFiles("test/mydb"); count > 4 {
+		t.Fatal("segments should be merged to MaxSegments, file count is ", count)
+	}
+
+	// segments written with a different block size are still readable
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	value, err := tx.Get([]byte("mykey9.999"))
+	if err != nil || string(value) != "myvalue999" {
+		t.Fatal("unable to get by key", err)
+	}
+	itr, err := tx.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal("unable to open iterator", err)
+	}
+	count := 0
+	for {
+		_, _, err = itr.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 10000 {
+		t.Fatal("incorrect count, should be 10000, is ", count)
+	}
+	tx.Commit()
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.OpenWithOptions("test/mydb", keydb.Options{CreateIfNeeded: true, MaxSegments: 1, MergeInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for i := 0; i < 3; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		err = tx.CommitSync()
+		if err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	snapshot, err := db.BeginReadTX("main")
+	if err != nil {
+		t.Fatal("unable to create snapshot", err)
+	}
+
+	for i := 3; i < 6; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Remove([]byte("mykey0"))
+		tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		err = tx.CommitSync()
+		if err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	// allow the merger to replace the segments used by the snapshot
+	time.Sleep(500 * time.Millisecond)
+
+	value, err := snapshot.Get([]byte("mykey0"))
+	if err != nil || string(value) != "myvalue0" {
+		t.Fatal("snapshot should see key removed after it was created", err)
+	}
+	_, err = snapshot.Get([]byte("mykey3"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("snapshot should not see key added after it was created", err)
+	}
+	itr, err := snapshot.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal("unable to open iterator", err)
+	}
+	count := 0
+	for {
+		_, _, err = itr.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 3 {
+		t.Fatal("incorrect count, should be 3, is ", count)
+	}
+
+	if db.Close() != keydb.DatabaseHasOpenTransactions {
+		t.Fatal("database should not close with an open snapshot")
+	}
+	err = snapshot.Close()
+	if err != nil {
+		t.Fatal("unable to close snapshot", err)
+	}
+	_, err = snapshot.Get([]byte("mykey0"))
+	if err != keydb.TransactionClosed {
+		t.Fatal("snapshot should be closed", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	if count := countFiles("test/mydb"); count != 2 {
+		t.Fatal("segments used by the snapshot should be removed, file count is ", count)
+	}
+}
+
+func TestMergeWithOpenTransaction(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.OpenWithOptions("test/mydb", keydb.Options{CreateIfNeeded: true, MaxSegments: 1, MergeInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey"), []byte("myvalue"))
+	tx.CommitSync()
+
+	open, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+
+	for i := 0; i < 4; i++ {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+		err = tx.CommitSync()
+		if err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	// the merger does not wait for the open transaction
+	time.Sleep(500 * time.Millisecond)
+
+	value, err := open.Get([]byte("mykey"))
+	if err != nil || string(value) != "myvalue" {
+		t.Fatal("unable to get by key", err)
+	}
+	err = open.Rollback()
+	if err != nil {
+		t.Fatal("unable to rollback", err)
+	}
+	if count := countFiles("test/mydb"); count != 2 {
+		t.Fatal("merged segments should be removed when the transaction completes, file count is ", count)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestMultiTransaction(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginMultiTX("main", "index")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	err = tx.Put("main", []byte("mykey"), []byte("myvalue"))
+	if err != nil {
+		t.Fatal("unable to put key/Value", err)
+	}
+	err = tx.Put("index", []byte("myvalue"), []byte("mykey"))
+	if err != nil {
+		t.Fatal("unable to put key/Value", err)
+	}
+	value, err := tx.Get("index", []byte("myvalue"))
+	if err != nil || string(value) != "mykey" {
+		t.Fatal("unable to get by key", err)
+	}
+	err = tx.Put("other", []byte("mykey"), []byte("myvalue"))
+	if err != keydb.TableNotInTransaction {
+		t.Fatal("should not be able to use a table outside the transaction", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal("unable to commit transaction", err)
+	}
+	err = tx.Commit()
+	if err != keydb.TransactionClosed {
+		t.Fatal("transaction should be closed", err)
+	}
+
+	tx, err = db.BeginMultiTX("main", "index")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Remove("main", []byte("mykey"))
+	tx.Remove("index", []byte("myvalue"))
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal("unable to rollback transaction", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err = db.BeginMultiTX("main", "index")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	value, err = tx.Get("main", []byte("mykey"))
+	if err != nil || string(value) != "myvalue" {
+		t.Fatal("unable to get by key", err)
+	}
+	value, err = tx.Get("index", []byte("myvalue"))
+	if err != nil || string(value) != "mykey" {
+		t.Fatal("unable to get by key", err)
+	}
+	tx.CommitSync()
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestSerializableTransaction(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, _ := db.BeginTX("main")
+	tx.Put([]byte("mykey"), []byte("1"))
+	tx.Commit()
+
+	// read-modify-write of the same key
+	tx1, err := db.BeginSerializableTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx2, err := db.BeginSerializableTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx1.Get([]byte("mykey"))
+	tx2.Get([]byte("mykey"))
+	tx2.Put([]byte("mykey"), []byte("2"))
+	err = tx2.Commit()
+	if err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	tx1.Put([]byte("mykey"), []byte("3"))
+	err = tx1.Commit()
+	if err != keydb.ErrConflict {
+		t.Fatal("commit should conflict", err)
+	}
+
+	// a range read conflicts with a key committed into the range
+	tx1, _ = db.BeginSerializableTX("main")
+	itr, _ := tx1.Lookup([]byte("a"), []byte("m"))
+	for {
+		_, _, err = itr.Next()
+		if err != nil {
+			break
+		}
+	}
+	tx, _ = db.BeginTX("main")
+	tx.Put([]byte("b"), []byte("b"))
+	tx.Commit()
+	tx1.Put([]byte("z"), []byte("z"))
+	err = tx1.CommitSync()
+	if err != keydb.ErrConflict {
+		t.Fatal("commit should conflict", err)
+	}
+
+	// unrelated keys do not conflict
+	tx1, _ = db.BeginSerializableTX("main")
+	tx1.Get([]byte("mykey"))
+	tx, _ = db.BeginTX("main")
+	tx.Put([]byte("other"), []byte("other"))
+	tx.Commit()
+	tx1.Put([]byte("mykey"), []byte("4"))
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, _ = db.BeginTX("main")
+	value, err := tx.Get([]byte("mykey"))
+	if err != nil || string(value) != "4" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+	_, err = tx.Get([]byte("z"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("conflicting commit should not be persisted", err)
+	}
+	tx.Rollback()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+}
+
+func TestTableManagement(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for _, table := range []string{"main", "index", "other"} {
+		tx, err := db.BeginTX(table)
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte("mykey"), []byte(table))
+		tx.Commit()
+	}
+
+	tables, err := db.Tables()
+	if err != nil || fmt.Sprint(tables) != "[index main other]" {
+		t.Fatal("incorrect tables", tables, err)
+	}
+
+	tx, _ := db.BeginTX("index")
+	err = db.DropTable("index")
+	if err != keydb.TableInUse {
+		t.Fatal("table with open transaction should not be dropped", err)
+	}
+	tx.Rollback()
+	err = db.DropTable("index")
+	if err != nil {
+		t.Fatal("unable to drop table", err)
+	}
+	err = db.DropTable("index")
+	if err != keydb.TableNotFound {
+		t.Fatal("table should not be found", err)
+	}
+
+	err = db.RenameTable("main", "other")
+	if err != keydb.TableExists {
+		t.Fatal("rename should not replace a table", err)
+	}
+	err = db.RenameTable("main", "renamed")
+	if err != nil {
+		t.Fatal("unable to rename table", err)
+	}
+	err = db.TruncateTable("other")
+	if err != nil {
+		t.Fatal("unable to truncate table", err)
+	}
+
+	tables, _ = db.Tables()
+	if fmt.Sprint(tables) != "[other renamed]" {
+		t.Fatal("incorrect tables", tables)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tables, _ = db.Tables()
+	if fmt.Sprint(tables) != "[other renamed]" {
+		t.Fatal("incorrect tables after open", tables)
+	}
+	tx, _ = db.BeginTX("renamed")
+	value, err := tx.Get([]byte("mykey"))
+	if err != nil || string(value) != "main" {
+		t.Fatal("renamed table should have the data", err)
+	}
+	tx.Rollback()
+	tx, _ = db.BeginTX("other")
+	_, err = tx.Get([]byte("mykey"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("truncated table should be empty", err)
+	}
+	tx.Rollback()
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	if count := countFiles("test/mydb"); count != 2 {
+		t.Fatal("only the renamed table should have segment files, file count is ", count)
+	}
+}
+
+func countKeys(t *testing.T, db *keydb.Database) int {
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	defer tx.Rollback()
+
+	itr, err := tx.Lookup(nil, nil)
+	if err != nil {
+		t.Fatal("unable to lookup", err)
+	}
+	count := 0
+	for {
+		_, _, err := itr.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+func TestDeleteRange(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	for i := 0; i < 100; i++ {
+		tx.Put([]byte(fmt.Sprintf("mykey%03d", i)), []byte("myvalue"))
+	}
+	err = tx.CommitSync()
+	if err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, _ = db.BeginTX("main")
+	err = tx.DeleteRange(nil, make([]byte, keydb.MaxKeyLength+1))
+	if err != keydb.KeyTooLong {
+		t.Fatal("bound should be too long", err)
+	}
+	err = tx.DeleteRange([]byte("mykey010"), []byte("mykey019"))
+	if err != nil {
+		t.Fatal("unable to delete range", err)
+	}
+	_, err = tx.Get([]byte("mykey012"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("key should be deleted", err)
+	}
+	tx.Put([]byte("mykey015"), []byte("myvalue"))
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal("unable to commit", err)
+	}
+
+	tx, _ = db.BeginTX("main")
+	_, err = tx.Get([]byte("mykey019"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("key should be deleted", err)
+	}
+	for _, key := range []string{"mykey009", "mykey015", "mykey020"} {
+		_, err = tx.Get([]byte(key))
+		if err != nil {
+			t.Fatal("key should not be deleted", key, err)
+		}
+	}
+	itr, _ := tx.LookupReverse([]byte("mykey005"), []byte("mykey025"))
+	count := 0
+	for {
+		_, _, err := itr.Next()
+		if err != nil {
+			break
+		}
+		count++
+	}
+	if count != 12 {
+		t.Fatal("incorrect count", count)
+	}
+	tx.Rollback()
+
+	if count := countKeys(t, db); count != 91 {
+		t.Fatal("incorrect count", count)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if count := countKeys(t, db); count != 91 {
+		t.Fatal("incorrect count after reopen", count)
+	}
+
+	tx, _ = db.BeginTX("main")
+	tx.DeleteRange([]byte("mykey090"), nil)
+	tx.CommitSync()
+
+	err = db.CloseWithMerge(1)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	manifest, _ := ioutil.ReadFile("test/mydb/manifest")
+	if strings.Contains(string(manifest), "deletedRanges") {
+		t.Fatal("range tombstones should be purged", string(manifest))
+	}
+
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if count := countKeys(t, db); count != 81 {
+		t.Fatal("incorrect count after merge", count)
+	}
+	db.Close()
+}
+
+func TestDelete(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	tx, _ := db.BeginTX("main")
+	tx.Put([]byte("mykey"), []byte("myvalue"))
+	tx.CommitSync()
+
+	tx, _ = db.BeginTX("main")
+	err = tx.Delete([]byte("mykey"))
+	if err != nil {
+		t.Fatal("unable to delete key", err)
+	}
+	err = tx.Delete([]byte("missing"))
+	if err != nil {
+		t.Fatal("deleting a missing key should not fail", err)
+	}
+	err = tx.Delete(nil)
+	if err != keydb.EmptyKey {
+		t.Fatal("empty key should not be deleted", err)
+	}
+	_, err = tx.Get([]byte("mykey"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("should not of found key", err)
+	}
+	tx.Commit()
+
+	if count := countKeys(t, db); count != 0 {
+		t.Fatal("incorrect count", count)
+	}
+	db.Close()
+}
+
+func TestMergeOperator(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	options := keydb.Options{CreateIfNeeded: true, MergeOperators: map[string]keydb.MergeOperator{"counters": keydb.Int64AddOperator}}
+	db, err := keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	one := make([]byte, 8)
+	binary.LittleEndian.PutUint64(one, 1)
+
+	for i := 0; i < 10; i++ {
+		tx, _ := db.BeginTX("counters")
+		err = tx.Merge([]byte("mykey"), one)
+		if err != nil {
+			t.Fatal("unable to merge", err)
+		}
+		tx.Merge([]byte("mykey"), one)
+		if i%2 == 0 {
+			err = tx.CommitSync()
+		} else {
+			err = tx.Commit()
+		}
+		if err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+
+	tx, _ := db.BeginTX("main")
+	err = tx.Merge([]byte("mykey"), one)
+	if err != keydb.NoMergeOperator {
+		t.Fatal("table without a merge operator should not merge", err)
+	}
+	tx.Rollback()
+
+	counter := func() int64 {
+		tx, _ := db.BeginTX("counters")
+		defer tx.Rollback()
+		value, err := tx.Get([]byte("mykey"))
+		if err != nil {
+			t.Fatal("unable to get counter", err)
+		}
+		itr, _ := tx.Lookup(nil, nil)
+		_, other, err := itr.Next()
+		if err != nil || !bytes.Equal(value, other) {
+			t.Fatal("lookup should apply the operands", other, err)
+		}
+		return int64(binary.LittleEndian.Uint64(value))
+	}
+
+	if counter() != 20 {
+		t.Fatal("incorrect counter", counter())
+	}
+
+	tx, _ = db.BeginTX("counters")
+	tx.Delete([]byte("mykey"))
+	tx.Merge([]byte("mykey"), one)
+	tx.Commit()
+
+	if counter() != 1 {
+		t.Fatal("incorrect counter after delete", counter())
+	}
+
+	// a deleted range removes the operands merged before it in the transaction
+	tx, _ = db.BeginTX("counters")
+	tx.Merge([]byte("other"), one)
+	tx.DeleteRange([]byte("other"), []byte("other"))
+	_, err = tx.Get([]byte("other"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("operand should be removed by the deleted range", err)
+	}
+	tx.CommitSync()
+	tx, _ = db.BeginTX("counters")
+	_, err = tx.Get([]byte("other"))
+	if err != keydb.KeyNotFound {
+		t.Fatal("operand should be removed by the deleted range after commit", err)
+	}
+	tx.Rollback()
+
+	err = db.CloseWithMerge(1)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	if counter() != 1 {
+		t.Fatal("incorrect counter after merge", counter())
+	}
+	db.Close()
+}
+
+type reverseComparator struct{}
+
+func (reverseComparator) Name() string {
+	return "reverse"
+}
+
+func (reverseComparator) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+func TestComparator(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	options := keydb.Options{CreateIfNeeded: true, Comparators: map[string]keydb.Comparator{"main": reverseComparator{}}}
+	db, err := keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		tx, _ := db.BeginTX("main")
+		for j := i; j < 1000; j += 3 {
+			tx.Put([]byte(fmt.Sprintf("mykey%03d", j)), []byte("myvalue"))
+		}
+		tx.CommitSync()
+	}
+
+	checkOrder := func() {
+		tx, _ := db.BeginTX("main")
+		defer tx.Rollback()
+		_, err := tx.Get([]byte("mykey500"))
+		if err != nil {
+			t.Fatal("unable to get key", err)
+		}
+		itr, _ := tx.Lookup([]byte("mykey899"), []byte("mykey100"))
+		count := 0
+		var prev []byte
+		for {
+			key, _, err := itr.Next()
+			if err != nil {
+				break
+			}
+			if prev != nil && bytes.Compare(key, prev) >= 0 {
+				t.Fatal("keys not in comparator order", string(prev), string(key))
+			}
+			prev = key
+			count++
+		}
+		if count != 800 {
+			t.Fatal("incorrect count", count)
+		}
+	}
+	checkOrder()
+
+	err = db.CloseWithMerge(1)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	_, err = keydb.Open("test/mydb", false)
+	if !errors.Is(err, keydb.ComparatorMismatch) {
+		t.Fatal("opening with a different comparator should fail", err)
+	}
+
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	checkOrder()
+	db.Close()
+}
+
+type typedValue struct {
+	Name  string
+	Count int
+}
+
+func TestTypedTable(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	table := keydb.NewTypedTable[string, typedValue]("typed", keydb.StringCodec{}, keydb.JSONCodec[typedValue]{})
+
+	tx, _ := table.BeginTX(db)
+	for i := 0; i < 10; i++ {
+		err = table.Put(tx, fmt.Sprint("key", i), typedValue{Name: fmt.Sprint("name", i), Count: i})
+		if err != nil {
+			t.Fatal("unable to put", err)
+		}
+	}
+	tx.CommitSync()
+
+	tx, _ = table.BeginTX(db)
+	value, err := table.Get(tx, "key5")
+	if err != nil {
+		t.Fatal("unable to get", err)
+	}
+	if value.Name != "name5" || value.Count != 5 {
+		t.Fatal("incorrect value", value)
+	}
+	_, err = table.Get(tx, "missing")
+	if err != keydb.KeyNotFound {
+		t.Fatal("should not of found key", err)
+	}
+
+	tx.Put([]byte("invalid"), []byte("not json"))
+	_, err = table.Get(tx, "invalid")
+	var codecErr *keydb.CodecError
+	if !errors.As(err, &codecErr) || codecErr.Op != "decode" || codecErr.Key {
+		t.Fatal("expected a value decode error", err)
+	}
+	tx.Remove([]byte("invalid"))
+
+	err = table.Delete(tx, "key0")
+	if err != nil {
+		t.Fatal("unable to delete", err)
+	}
+
+	lower, upper := "key3", "key6"
+	itr, err := table.Lookup(tx, &lower, &upper)
+	if err != nil {
+		t.Fatal("unable to lookup", err)
+	}
+	count := 0
+	for {
+		key, value, err := itr.Next()
+		if err == keydb.EndOfIterator {
+			break
+		}
+		if err != nil {
+			t.Fatal("iterator failed", err)
+		}
+		if key != fmt.Sprint("key", count+3) || value.Count != count+3 {
+			t.Fatal("incorrect record", key, value)
+		}
+		count++
+	}
+	if count != 4 {
+		t.Fatal("incorrect count", count)
+	}
+
+	itr, _ = table.Lookup(tx, nil, nil)
+	key, _, _ := itr.Next()
+	if key != "key1" {
+		t.Fatal("deleted key should not be returned", key)
+	}
+	tx.Commit()
+
+	tx, _ = db.BeginTX("main")
+	_, err = table.Get(tx, "key1")
+	if err != keydb.TableNotInTransaction {
+		t.Fatal("should not of used transaction for another table", err)
+	}
+	tx.Rollback()
+
+	db.Close()
+}
+
+type testCompressor struct {
+	keydb.Compressor
+}
+
+func (testCompressor) Name() string {
+	return "test"
+}
+
+func TestCompression(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	put := func(db *keydb.Database, from int, to int) {
+		tx, _ := db.BeginTX("ticks")
+		for i := from; i < to; i++ {
+			tx.Put([]byte(fmt.Sprintf("tick%05d", i)), []byte(fmt.Sprintf("value%050d", i)))
+		}
+		tx.CommitSync()
+	}
+	check := func(db *keydb.Database, count int) {
+		tx, _ := db.BeginTX("ticks")
+		defer tx.Commit()
+		for i := 0; i < count; i++ {
+			value, err := tx.Get([]byte(fmt.Sprintf("tick%05d", i)))
+			if err != nil || string(value) != fmt.Sprintf("value%050d", i) {
+				t.Fatal("incorrect value", i, err)
+			}
+		}
+	}
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	put(db, 0, 1000)
+	db.Close()
+
+	// new segments are compressed, and are merged with the uncompressed segments
+	options := keydb.Options{Compressors: map[string]keydb.Compressor{"ticks": testCompressor{keydb.NewFlateCompressor(9)}}}
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	put(db, 1000, 2000)
+	check(db, 2000)
+	db.Close()
+
+	_, err = keydb.Open("test/mydb", false)
+	if !errors.Is(err, keydb.UnknownCompressor) {
+		t.Fatal("database should not open without the compressor", err)
+	}
+
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	check(db, 2000)
+	err = db.CloseWithMerge(1)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	check(db, 2000)
+	db.Close()
+
+	// the compressor is recorded in the segment, so the segments are readable without the manifest
+	err = os.Remove("test/mydb/manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err = keydb.OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database without manifest", err)
+	}
+	check(db, 2000)
+	db.Close()
+}
+
+func TestLargeKeys(t *testing.T) {
+	keydb.Remove("test/mydb")
+
+	db, err := keydb.Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+
+	largeKey := func(i int, size int) []byte {
+		return append(bytes.Repeat([]byte{'k'}, size), []byte(fmt.Sprint(i))...)
+	}
+	largeValue := bytes.Repeat([]byte("value"), 1000000)
+
+	tx, _ := db.BeginTX("main")
+	for i := 0; i < 10; i++ {
+		err = tx.Put(largeKey(i, 5000*i), []byte(fmt.Sprint("myvalue", i)))
+		if err != nil {
+			t.Fatal("unable to put large key", err)
+		}
+	}
+	tx.Put([]byte("largevalue"), largeValue)
+	tx.CommitSync()
+	err = db.CloseWithMerge(1)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	db, err = keydb.Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, _ = db.BeginTX("main")
+	for i := 0; i < 10; i++ {
+		value, err := tx.Get(largeKey(i, 5000*i))
+		if err != nil || string(value) != fmt.Sprint("myvalue", i) {
+			t.Fatal("incorrect value", i, err)
+		}
+	}
+	value, err := tx.Get([]byte("largevalue"))
+	if err != nil || !bytes.Equal(value, largeValue) {
+		t.Fatal("incorrect large value", err)
+	}
+	tx.Commit()
+	db.Close()
+}
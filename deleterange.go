@@ -0,0 +1,58 @@
+package keydb
+
+// DeleteRange records a range tombstone rather than removing every key in the range. a range tombstone belongs to
+// a segment, and removes the keys in the range from all of the older segments of the table. the keys in the range
+// that are in the segment itself are marked as removed when the range is deleted, so a key written to the segment
+// afterwards is not affected. the range tombstones of a disk segment are recorded in the manifest, and a merge keeps
+// the range tombstones of the merged segments, unless the merge includes the oldest segment, in which case the range
+// tombstones and the keys they remove are dropped.
+
+// keyRange is a range of keys between lower and upper inclusive. a nil lower or upper is unbounded on that side
+type keyRange struct {
+	lower []byte
+	upper []byte
+}
+
+func (r keyRange) contains(c Comparator, key []byte) bool {
+	return (r.lower == nil || !less(c, key, r.lower)) && (r.upper == nil || !less(c, r.upper, key))
+}
+
+func (r keyRange) overlaps(c Comparator, other keyRange) bool {
+	return (r.lower == nil || other.upper == nil || !less(c, other.upper, r.lower)) &&
+		(r.upper == nil || other.lower == nil || !less(c, r.upper, other.lower))
+}
+
+func rangesContain(c Comparator, ranges []keyRange, key []byte) bool {
+	for _, r := range ranges {
+		if r.contains(c, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func rangesOverlap(c Comparator, ranges []keyRange, other keyRange) bool {
+	for _, r := range ranges {
+		if r.overlaps(c, other) {
+			return true
+		}
+	}
+	return false
+}
+
+// DeleteRange removes all of the keys between lower and upper inclusive from the table. lower or upper can be nil
+// and then the range is unbounded on that side. unlike Remove, the removed keys are not read, and the range is
+// recorded as a single entry no matter how many keys it contains
+func (tx *Transaction) DeleteRange(lower []byte, upper []byte) error {
+	if !tx.open {
+		return TransactionClosed
+	}
+	if len(lower) > MaxKeyLength || len(upper) > MaxKeyLength {
+		return KeyTooLong
+	}
+	if upper != nil && (len(upper) == 0 || (lower != nil && less(tx.multi.comparator, upper, lower))) {
+		// no key is in the range
+		return nil
+	}
+	return tx.memory.DeleteRange(append([]byte(nil), lower...), append([]byte(nil), upper...))
+}
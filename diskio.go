@@ -2,92 +2,180 @@ package keydb
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"os"
-	"path/filepath"
+	"time"
 )
 
-const keyBlockSize = 4096
+// the key record format of version 1 and 2 segments
 const maxKeySize = 1000
 const endOfBlock uint16 = 0x8000
 const compressedBit uint16 = 0x8000
 const maxPrefixLen uint16 = 0xFF ^ 0x80
 const maxCompressedLen uint16 = 0xFF
-const keyIndexInterval int = 16
 const removedKeyLen = 0xFFFFFFFF
+const operandBit = 0x80000000
+
+// the record types of version 3 segments, which are also used for the decoded records of earlier versions
+const (
+	recordEnd     byte = 0
+	recordValue   byte = 1
+	recordRemoved byte = 2
+	recordOperand byte = 3
+)
+
+// MaxKeyLength is the length of the longest key. a key must fit in a single key block, so a segment with a key that
+// does not fit in the KeyBlockSize is written with larger blocks, up to the largest block size
+const MaxKeyLength = maxKeyBlockSize - 64
 
 var errEmptySegment = errors.New("empty segment")
 
-// called to write a memory segment to disk
-func writeSegmentToDisk(db *Database, table string, seg segment) error {
-	var err error
+// errBlockTooSmall is returned by writeSegmentFiles if a key does not fit in a key block
+var errBlockTooSmall = errors.New("key does not fit in key block")
+
+// writes the committed memory segments of a transaction to disk in the background. the database wait group allows
+// the database to close with no writers pending
+func writeSegmentsToDiskAsync(db *Database, seq uint64, tables []logTable) {
+	db.wg.Add(1)
+
+	go func() {
+		defer db.wg.Done()
+		err := writeSegmentsToDisk(db, seq, tables)
+		if err != nil {
+			db.Lock()
+			db.err = errors.New("transaction failed: " + err.Error())
+			db.Unlock()
+		}
+	}()
+}
 
-	itr, err := seg.Lookup(nil, nil)
+// called to write the committed memory segments of a transaction to disk. the disk segments replace the memory
+// segments in all of the tables at once, and are recorded in a single manifest update, along with the log sequence
+// number of the commit. if the segments can not be written, the later commits are not written either
+func writeSegmentsToDisk(db *Database, seq uint64, tables []logTable) error {
+	err := writeCommitToDisk(db, seq, tables)
 	if err != nil {
-		return err
+		db.log.failed(err)
 	}
+	return err
+}
 
-	id := db.nextSegmentID()
+func writeCommitToDisk(db *Database, seq uint64, tables []logTable) error {
+	disk := make([]segment, len(tables))
 
-	keyFilename := filepath.Join(db.path, fmt.Sprint(table, ".keys.", id))
-	dataFilename := filepath.Join(db.path, fmt.Sprint(table, ".data.", id))
+	for i, lt := range tables {
+		itr, err := lt.memory.Lookup(nil, nil)
+		if err != nil {
+			releaseSegments(disk)
+			return err
+		}
 
-	ds, err := writeAndLoadSegment(keyFilename, dataFilename, itr)
-	if err != nil && err != errEmptySegment {
-		return err
+		id := db.nextSegmentID()
+
+		keyFilename, dataFilename := segmentFilenames(db.path, lt.table, manifestSegment{ID: id})
+
+		ds, err := writeAndLoadSegment(keyFilename, dataFilename, itr, db.options.segmentFormat(lt.table), lt.memory.deletedRanges(), nil)
+		if err != nil && err != errEmptySegment {
+			releaseSegments(disk)
+			return err
+		}
+		disk[i] = ds
 	}
 
-	db.tables[table].Lock()
-	defer db.tables[table].Unlock()
+	// the segments are written concurrently, but are recorded in the manifest in the order of the commits
+	err := db.log.waitFlush(seq)
+	if err != nil {
+		releaseSegments(disk)
+		return err
+	}
 
-	segments := make([]segment, 0)
-	for _, v := range db.tables[table].segments {
-		if v == seg {
-			if ds != nil {
-				segments = append(segments, ds)
+	its := make([]*internalTable, len(tables))
+	db.Lock()
+	for i, lt := range tables {
+		its[i] = db.tables[lt.table]
+	}
+	db.Unlock()
+
+	lockTables(its)
+	defer unlockTables(its)
+
+	for i, lt := range tables {
+		table := its[i]
+		segments := make([]segment, 0)
+		for _, v := range table.segments {
+			if v == lt.memory {
+				if disk[i] != nil {
+					segments = append(segments, disk[i])
+				}
+			} else {
+				segments = append(segments, v)
 			}
-		} else {
-			segments = append(segments, v)
 		}
+		table.segments = segments
 	}
 
-	db.tables[table].segments = segments
-
-	return nil
+	err = updateManifestFlushed(db, seq, its...)
+	if err != nil {
+		return err
+	}
+	return db.log.flushed()
 }
 
-func writeAndLoadSegment(keyFilename, dataFilename string, itr LookupIterator) (segment, error) {
+// writeAndLoadSegment writes the keys of the iterator to a new segment, along with the range tombstones of the segment.
+// sources are the ids of the segments merged to create it. the error is errEmptySegment if there are no keys or range
+// tombstones
+func writeAndLoadSegment(keyFilename, dataFilename string, itr LookupIterator, format segmentFormat, deleted []keyRange, sources []uint64) (segment, error) {
 
 	keyFilenameTmp := keyFilename + ".tmp"
 	dataFilenameTmp := dataFilename + ".tmp"
 
-	keyIndex, err := writeSegmentFiles(keyFilenameTmp, dataFilenameTmp, itr)
+	keyIndex, err := writeSegmentFiles(keyFilenameTmp, dataFilenameTmp, itr, format, len(deleted) > 0, sources)
+	for err == errBlockTooSmall && format.keyBlockSize < maxKeyBlockSize && format.version >= segmentVersion3 {
+		// the block size is recorded for every segment, so the segment can be rewritten with larger blocks
+		format.keyBlockSize *= 2
+		if format.keyBlockSize > maxKeyBlockSize {
+			format.keyBlockSize = maxKeyBlockSize
+		}
+		err = itr.Seek(nil)
+		if err == nil {
+			keyIndex, err = writeSegmentFiles(keyFilenameTmp, dataFilenameTmp, itr, format, len(deleted) > 0, sources)
+		}
+	}
 	if err != nil {
 		os.Remove(keyFilenameTmp)
 		os.Remove(dataFilenameTmp)
 		return nil, err
 	}
 
-	os.Rename(keyFilenameTmp, keyFilename)
-	os.Rename(dataFilenameTmp, dataFilename)
+	err = errn(os.Rename(keyFilenameTmp, keyFilename), os.Rename(dataFilenameTmp, dataFilename))
+	if err != nil {
+		return nil, err
+	}
 
-	return newDiskSegment(keyFilename, dataFilename, keyIndex), nil
+	ds, err := newDiskSegment(keyFilename, dataFilename, format, keyIndex)
+	if err != nil {
+		return nil, err
+	}
+	ds.(*diskSegment).deleted = deleted
+	return ds, nil
 }
 
-func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte, error) {
+// writeSegmentFiles writes the keys of the iterator to the segment files. if there are no keys, the files are only
+// written if allowEmpty is true, otherwise the error is errEmptySegment
+func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator, format segmentFormat, allowEmpty bool, sources []uint64) ([][]byte, error) {
 
 	var keyIndex [][]byte
 
-	keyF, err := os.OpenFile(keyFName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	keyF, err := os.OpenFile(keyFName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 	defer keyF.Close()
 
-	dataF, err := os.OpenFile(dataFName, os.O_CREATE|os.O_WRONLY, os.ModePerm)
+	dataF, err := os.OpenFile(dataFName, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
@@ -95,35 +183,100 @@ func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte
 
 	keyW := bufio.NewWriter(keyF)
 	dataW := bufio.NewWriter(dataF)
+	keyBlocks := &blockWriter{w: keyW, compressor: format.compressor}
+	values := &valueWriter{blockWriter: blockWriter{w: dataW, compressor: format.compressor}}
+
+	footer := segmentFooter{keyIndexInterval: format.keyIndexInterval, created: time.Now(), sources: sources}
+	if format.version >= segmentVersion4 {
+		header := encodeSegmentHeader(format)
+		_, err = keyW.Write(header)
+		if err != nil {
+			return nil, err
+		}
+		keyBlocks.offset = int64(len(header))
+	}
 
 	var dataOffset int64
 	var keyBlockLen int
 	var keyCount = 0
 	var block = 0
 
-	var zeros = make([]byte, keyBlockSize)
+	var keyBlockSize = format.keyBlockSize
+	var blockBuffer = make([]byte, keyBlockSize)
+	var blockLimit = keyBlockSize - 1 // need to leave room for 'end of block marker'
+	if format.version < segmentVersion3 {
+		blockLimit = keyBlockSize - 2
+	}
+	if format.checksums() {
+		blockLimit -= 4
+	}
+
+	// writes the 'end of block marker', padding, and checksum for the current block
+	finishBlock := func() error {
+		for i := keyBlockLen; i < keyBlockSize; i++ {
+			blockBuffer[i] = 0
+		}
+		if format.version < segmentVersion3 {
+			binary.LittleEndian.PutUint16(blockBuffer[keyBlockLen:], endOfBlock)
+		}
+		if format.checksums() {
+			checksum := crc32.Checksum(blockBuffer[:keyBlockSize-4], crcTable)
+			binary.LittleEndian.PutUint32(blockBuffer[keyBlockSize-4:], checksum)
+		}
+		keyBlockLen = 0
+		footer.keyBlocks++
+		return keyBlocks.write(blockBuffer)
+	}
 
 	var prevKey []byte
+	var checksum [4]byte
+	var hashes []uint64
+	var rec []byte
 
 	for {
-		key, value, err := itr.Next()
-		if err != nil {
+		key, value, operand, err := nextRecord(itr)
+		if err == EndOfIterator {
 			break
 		}
+		if err != nil {
+			return nil, err
+		}
+		if format.version < segmentVersion3 && (len(value) >= operandBit || len(key) > maxKeySize) {
+			return nil, errors.New("key or value too large")
+		}
 		keyCount++
+		if value == nil {
+			footer.tombstones++
+		}
+		if format.bloomBitsPerKey > 0 {
+			hashes = append(hashes, bloomHash(key))
+		}
+
+		record := recordValue
+		if value == nil {
+			record = recordRemoved
+		} else if operand {
+			record = recordOperand
+		}
 
-		dataW.Write(value)
-		if keyBlockLen+2+len(key)+8+4 >= keyBlockSize-2 { // need to leave room for 'end of block marker'
+		rec = appendRecord(rec[:0], format.version, key, prevKey, record, dataOffset, uint64(len(value)))
+		if keyBlockLen+len(rec) > blockLimit {
 			// key won't fit in block so move to next
-			binary.Write(keyW, binary.LittleEndian, endOfBlock)
-			keyBlockLen += 2
-			keyW.Write(zeros[:keyBlockSize-keyBlockLen])
-			keyBlockLen = 0
+			if keyBlockLen > 0 {
+				err = finishBlock()
+				if err != nil {
+					return nil, err
+				}
+			}
 			prevKey = nil
+			rec = appendRecord(rec[:0], format.version, key, prevKey, record, dataOffset, uint64(len(value)))
+			if len(rec) > blockLimit {
+				return nil, errBlockTooSmall
+			}
 		}
 
 		if keyBlockLen == 0 {
-			if block%keyIndexInterval == 0 {
+			if block%format.keyIndexInterval == 0 {
 				keycopy := make([]byte, len(key))
 				copy(keycopy, key)
 				keyIndex = append(keyIndex, keycopy)
@@ -131,56 +284,115 @@ func writeSegmentFiles(keyFName, dataFName string, itr LookupIterator) ([][]byte
 			block++
 		}
 
-		var dataLen uint32
-		if value == nil {
-			dataLen = removedKeyLen
-		} else {
-			dataLen = uint32(len(value))
+		if value != nil {
+			err = values.write(value)
+			if err != nil {
+				return nil, err
+			}
+			if format.checksums() {
+				binary.LittleEndian.PutUint32(checksum[:], crc32.Checksum(value, crcTable))
+				err = values.write(checksum[:])
+				if err != nil {
+					return nil, err
+				}
+			}
 		}
 
-		dk := encodeKey(key, prevKey)
 		prevKey = make([]byte, len(key))
 		copy(prevKey, key)
+		if footer.firstKey == nil {
+			footer.firstKey = prevKey
+		}
+		footer.lastKey = prevKey
 
-		var data = []interface{}{
-			uint16(dk.keylen),
-			dk.compressedKey,
-			int64(dataOffset),
-			uint32(dataLen)}
-		buf := new(bytes.Buffer)
-		for _, v := range data {
-			err = binary.Write(buf, binary.LittleEndian, v)
-			if err != nil {
-				goto failed
+		keyBlockLen += copy(blockBuffer[keyBlockLen:], rec)
+
+		if value != nil {
+			dataOffset += int64(len(value))
+			if format.checksums() {
+				dataOffset += 4
 			}
 		}
-		keyBlockLen += 2 + len(dk.compressedKey) + 8 + 4
-		keyW.Write(buf.Bytes())
-		if value != nil {
-			dataOffset += int64(dataLen)
+	}
+
+	if keyCount == 0 && !allowEmpty {
+		return nil, errEmptySegment
+	}
+
+	// pad key file to block size. an empty segment has a single empty block
+	if keyBlockLen > 0 || keyCount == 0 {
+		err = finishBlock()
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	// pad key file to block size
-	if keyBlockLen > 0 && keyBlockLen < keyBlockSize {
-		// key won't fit in block so move to next
-		binary.Write(keyW, binary.LittleEndian, endOfBlock)
-		keyBlockLen += 2
-		keyW.Write(zeros[:keyBlockSize-keyBlockLen])
-		keyBlockLen = 0
+	if format.compressor != nil {
+		err = values.finish()
+		if err != nil {
+			return nil, err
+		}
+		_, err = keyW.Write(encodeBlockIndex(keyBlocks, values))
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	keyW.Flush()
-	dataW.Flush()
+	if format.version >= segmentVersion4 {
+		footer.keyIndex = keyIndex
+		footer.entries = uint64(keyCount)
+		_, err = keyW.Write(encodeSegmentFooter(footer))
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	if keyCount == 0 {
-		return nil, errEmptySegment
+	if format.bloomBitsPerKey > 0 {
+		_, err = dataW.Write(encodeBloomTrailer(newBloomFilter(hashes, format.bloomBitsPerKey)))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the segment must be on stable storage before it is recorded in the manifest
+	err = errn(keyW.Flush(), dataW.Flush())
+	if err != nil {
+		return nil, err
+	}
+	err = errn(keyF.Sync(), dataF.Sync())
+	if err != nil {
+		return nil, err
 	}
 
 	return keyIndex, nil
+}
 
-failed:
-	return nil, err
+// appendRecord appends the key record for a key to a key block, the prefix shared with the previous key in the block is
+// not repeated. the length is ignored for removed keys
+func appendRecord(buf []byte, version int, key []byte, prevKey []byte, record byte, offset int64, length uint64) []byte {
+	if version < segmentVersion3 {
+		dk := encodeKey(key, prevKey)
+		dataLen := uint32(length)
+		if record == recordRemoved {
+			dataLen = removedKeyLen
+		} else if record == recordOperand {
+			dataLen |= operandBit
+		}
+		buf = binary.LittleEndian.AppendUint16(buf, dk.keylen)
+		buf = append(buf, dk.compressedKey...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(offset))
+		return binary.LittleEndian.AppendUint32(buf, dataLen)
+	}
+	prefixLen := sharedPrefixLen(prevKey, key)
+	buf = append(buf, record)
+	buf = binary.AppendUvarint(buf, uint64(prefixLen))
+	buf = binary.AppendUvarint(buf, uint64(len(key)-prefixLen))
+	buf = append(buf, key[prefixLen:]...)
+	if record == recordRemoved {
+		return buf
+	}
+	buf = binary.AppendUvarint(buf, uint64(offset))
+	return binary.AppendUvarint(buf, length)
 }
 
 type diskkey struct {
@@ -217,25 +429,29 @@ func decodeKeyLen(keylen uint16) (prefixLen, compressedLen uint16, err error) {
 	return
 }
 
-func decodeKey(key, prevKey []byte, prefixLen uint16) []byte {
-	if prefixLen != 0 {
-		key = append(prevKey[:prefixLen], key...)
-	}
-	return key
+// decodeKey returns a new slice holding the key, so that it is not changed by reading the next key or block
+func decodeKey(key, prevKey []byte, prefixLen int) []byte {
+	decoded := make([]byte, prefixLen+len(key))
+	copy(decoded, prevKey[:prefixLen])
+	copy(decoded[prefixLen:], key)
+	return decoded
 }
 
 func calculatePrefixLen(prevKey []byte, key []byte) int {
-	if prevKey == nil {
-		return 0
+	length := sharedPrefixLen(prevKey, key)
+	if length > int(maxPrefixLen) || len(key)-length > int(maxCompressedLen) {
+		length = 0
 	}
+	return length
+}
+
+// sharedPrefixLen returns the length of the common prefix of the keys
+func sharedPrefixLen(prevKey []byte, key []byte) int {
 	var length = 0
 	for ; length < len(prevKey) && length < len(key); length++ {
 		if prevKey[length] != key[length] {
 			break
 		}
 	}
-	if length > int(maxPrefixLen) || len(key)-length > int(maxCompressedLen) {
-		length = 0
-	}
 	return length
 }
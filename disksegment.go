@@ -1,22 +1,23 @@
 package keydb
 
 import (
-	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"io/ioutil"
+	"hash/crc32"
+	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 )
 
-// the key file uses 4096 byte blocks, the format is
+// the key file uses fixed size blocks (4096 bytes unless the KeyBlockSize option is set), the format is
 // keylen uint16
 // key []byte
 // dataoffset int64
-// datalen uint32 (if datalen is 0, the key is "removed"
+// datalen uint32 (if datalen is 0xFFFFFFFF, the key is "removed", otherwise if the high bit is set the value is a merge operand)
 //
 // keylen supports compressed keys. if the high bit is set, then the key is compressed,
 // with the 8 lower bits for the key len, and the next 7 bits for the run length. a block
@@ -24,18 +25,55 @@ import (
 //
 // the special value of 0x7000 marks the end of a block
 //
+// in version 2 and later segments the last 4 bytes of each block hold the crc32c of the rest of the block
+//
+// version 3 segments use a key record format with varint lengths instead, each record being
+// record type byte (recordEnd marks the end of a block)
+// prefixlen uvarint (the length of the prefix shared with the previous key in the block, 0 for the first key)
+// keylen uvarint (the length of the rest of the key)
+// key []byte
+// dataoffset uvarint (unless the record type is recordRemoved)
+// datalen uvarint (unless the record type is recordRemoved)
+//
 // the data file can only be read in conjunction with the key
 // file since there is no length attribute, it is a raw appended
-// byte array with the offset and length in the key file
+// byte array with the offset and length in the key file. in version 2
+// segments each value is followed by its crc32c. if the segment has a bloom filter, it
+// follows the last value (see bloom.go)
 //
+// the blocks of compressed segments are stored compressed, see compression.go
 type diskSegment struct {
 	keyFile   *memoryMappedFile
 	keyBlocks int64
 	dataFile  *memoryMappedFile
 	id        uint64
+	format    segmentFormat
 	// nil for segments loaded during initial open
 	// otherwise holds the key for every keyIndexInterval block
 	keyIndex [][]byte
+	// nil if the segment has no bloom filter
+	filter bloomFilter
+	// the table holds a reference to each of its disk segments, as does every open transaction and snapshot that
+	// uses the segment. a segment replaced by a merge is obsolete, and its files are removed when the last
+	// reference is released
+	refs     int32
+	obsolete bool
+	// the range tombstones of the segment, which are recorded in the manifest
+	deleted []keyRange
+	// identifies the segment in the block cache
+	cacheID uint64
+	// the offset of the first key block in the key file
+	blocksOffset int64
+	// the metadata of version 4 segments, see segmentfooter.go
+	footer segmentFooter
+	// the first and last key of the segment
+	keyBounds keyRange
+	// the block index of a compressed segment, see compression.go
+	keyOffsets  []int64
+	dataOffsets []int64
+	dataLength  int64
+	// the last data block read from a compressed segment
+	lastDataBlock atomic.Pointer[dataBlock]
 }
 
 type diskSegmentIterator struct {
@@ -47,40 +85,45 @@ type diskSegmentIterator struct {
 	bufferOffset int
 	key          []byte
 	data         []byte
+	operand      bool
 	isValid      bool
 	err          error
 	finished     bool
+	// the position set by Seek, keys before it are skipped
+	start []byte
+	// reverse iterators decode a block at a time, and return its entries from last to first
+	reverse    bool
+	entries    []blockEntry
+	entryIndex int
+}
+
+// blockEntry is a decoded key record from a key block
+type blockEntry struct {
+	key    []byte
+	record byte
+	offset int64
+	length uint64
 }
 
 var errKeyRemoved = errors.New("key removed")
+var errEndOfBlock = errors.New("end of block")
 
-func loadDiskSegments(directory string, table string) []segment {
-	files, err := ioutil.ReadDir(directory)
-	if err != nil {
-		return []segment{}
-	}
+// loadDiskSegments opens the segments of a table that are listed in the manifest
+func loadDiskSegments(db *Database, table string) ([]segment, error) {
 	segments := []segment{}
-	for _, file := range files {
-		if strings.HasSuffix(file.Name(), ".tmp") {
-			panic("tmp files in " + directory)
-		}
-		if strings.HasPrefix(file.Name(), table+".") {
-			index := strings.Index(file.Name(), ".keys.")
-			if index < 0 {
-				continue
-
+	for _, ms := range db.manifest.segments(table) {
+		keyFilename, dataFilename := segmentFilenames(db.path, table, ms)
+		ds, err := newDiskSegment(keyFilename, dataFilename, ms.format(db.options, table), nil) // don't have keyIndex
+		if err != nil {
+			for _, s := range segments {
+				s.Close()
 			}
-			base := file.Name()[:index]
-			id := getSegmentID(file.Name())
-			keyFilename := filepath.Join(directory, base+".keys."+strconv.FormatUint(id, 10))
-			dataFilename := filepath.Join(directory, base+".data."+strconv.FormatUint(id, 10))
-			segments = append(segments, newDiskSegment(keyFilename, dataFilename, nil)) // don't have keyIndex
+			return nil, err
 		}
+		ds.(*diskSegment).deleted = ms.deletedRanges()
+		segments = append(segments, ds)
 	}
-	sort.Slice(segments, func(i, j int) bool {
-		return segments[i].(*diskSegment).id < segments[j].(*diskSegment).id
-	})
-	return segments
+	return segments, nil
 }
 
 func getSegmentID(filename string) uint64 {
@@ -95,55 +138,226 @@ func getSegmentID(filename string) uint64 {
 	return 0
 }
 
-func newDiskSegment(keyFilename, dataFilename string, keyIndex [][]byte) segment {
+func newDiskSegment(keyFilename, dataFilename string, format segmentFormat, keyIndex [][]byte) (segment, error) {
 
 	segmentID := getSegmentID(keyFilename)
 
-	ds := &diskSegment{}
+	err := checkSegmentFiles(keyFilename, dataFilename, format)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := &diskSegment{refs: 1, cacheID: newCacheID()}
 	kf, err := newMemoryMappedFile(keyFilename)
 	if err != nil {
-		panic(err)
+		return nil, &SegmentError{Filename: keyFilename, Err: err}
 	}
 	df, err := newMemoryMappedFile(dataFilename)
 	if err != nil {
-		panic(err)
+		kf.Close()
+		return nil, &SegmentError{Filename: dataFilename, Err: err}
 	}
 	ds.keyFile = kf
 	ds.dataFile = df
 
-	ds.keyBlocks = (kf.Length()-1)/keyBlockSize + 1
+	ds.format = format
+	ds.keyBlocks = (kf.Length()-1)/int64(format.keyBlockSize) + 1
 	ds.id = segmentID
 
+	blocksEnd := kf.Length()
+	if format.version >= segmentVersion4 {
+		ds.footer, blocksEnd, err = loadSegmentFooter(ds)
+		if err != nil {
+			ds.Close()
+			return nil, err
+		}
+		ds.keyBlocks = ds.footer.keyBlocks
+		// the key index was written with the interval of the segment
+		ds.format.keyIndexInterval = ds.footer.keyIndexInterval
+		keyIndex = ds.footer.keyIndex
+		if format.compressor == nil && ds.blocksOffset+ds.keyBlocks*int64(format.keyBlockSize) != blocksEnd {
+			ds.Close()
+			return nil, &SegmentError{Filename: keyFilename, Err: SegmentCorrupted}
+		}
+	}
+
+	if format.compressor != nil {
+		err = loadBlockIndex(ds, blocksEnd)
+		if err == nil && format.version >= segmentVersion4 && ds.keyBlocks != ds.footer.keyBlocks {
+			err = &SegmentError{Filename: keyFilename, Err: SegmentCorrupted}
+		}
+		if err != nil {
+			ds.Close()
+			return nil, err
+		}
+	}
+
 	if keyIndex == nil {
 		// TODO maybe load this in the background
-		keyIndex = loadKeyIndex(kf, ds.keyBlocks)
+		keyIndex, err = loadKeyIndex(ds)
+		if err != nil {
+			ds.Close()
+			return nil, err
+		}
 	}
 
 	ds.keyIndex = keyIndex
 
-	return ds
+	if format.version >= segmentVersion4 {
+		ds.keyBounds = keyRange{lower: ds.footer.firstKey, upper: ds.footer.lastKey}
+	} else if len(keyIndex) > 0 {
+		// older segments have no footer, so the last key is read from the last block
+		ds.keyBounds.lower = keyIndex[0]
+		ds.keyBounds.upper, err = loadLastKey(ds)
+		if err != nil {
+			ds.Close()
+			return nil, err
+		}
+	}
+
+	if format.bloomBitsPerKey > 0 {
+		ds.filter, err = loadBloomFilter(ds)
+		if err != nil {
+			ds.Close()
+			return nil, err
+		}
+	}
+
+	return ds, nil
 }
 
-func loadKeyIndex(kf *memoryMappedFile, keyBlocks int64) [][]byte {
-	buffer := make([]byte, keyBlockSize)
+func loadKeyIndex(ds *diskSegment) ([][]byte, error) {
+	buffer := make([]byte, ds.format.keyBlockSize)
 	keyIndex := make([][]byte, 0)
 	// build key index
 	var block int64
-	for block = 0; block < keyBlocks; block += int64(keyIndexInterval) {
-		_, err := kf.ReadAt(buffer, block*keyBlockSize)
+	for block = 0; block < ds.keyBlocks; block += int64(ds.format.keyIndexInterval) {
+		err := ds.readBlock(buffer, block)
 		if err != nil {
-			keyIndex = nil
-			break
+			return nil, err
 		}
-		keylen := binary.LittleEndian.Uint16(buffer)
-		if keylen == endOfBlock {
+		entry, _, err := ds.decodeRecord(buffer, 0, nil)
+		if err == errEndOfBlock {
 			break
 		}
-		keycopy := make([]byte, keylen)
-		copy(keycopy, buffer[2:2+keylen])
-		keyIndex = append(keyIndex, keycopy)
+		if err != nil {
+			return nil, err
+		}
+		keyIndex = append(keyIndex, entry.key)
+	}
+	return keyIndex, nil
+}
+
+// loadLastKey returns the last key of the last block of the segment
+func loadLastKey(ds *diskSegment) ([]byte, error) {
+	entries, err := ds.readEntries(ds.keyBlocks-1, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, &SegmentError{Filename: ds.keyFile.Name(), Err: SegmentCorrupted}
+	}
+	return entries[len(entries)-1].key, nil
+}
+
+// readBlock reads a key block into the buffer, decompressing it if the segment is compressed, and verifying the
+// block checksum
+func (ds *diskSegment) readBlock(buffer []byte, block int64) error {
+	offset := ds.blocksOffset + block*int64(ds.format.keyBlockSize)
+	n := len(buffer)
+	var err error
+	if ds.format.compressor != nil {
+		err = readCompressed(ds.keyFile, ds.format.compressor, ds.keyOffsets, block, buffer)
+		if err == nil {
+			offset = ds.keyOffsets[block]
+		}
+	} else {
+		n, err = ds.keyFile.ReadAt(buffer, offset)
+	}
+	if err != nil {
+		return err
+	}
+	if n != ds.format.keyBlockSize {
+		return errors.New(fmt.Sprint("did not read block size, read ", n))
+	}
+	if ds.format.checksums() {
+		checksum := binary.LittleEndian.Uint32(buffer[n-4:])
+		if crc32.Checksum(buffer[:n-4], crcTable) != checksum {
+			return &ErrCorruption{Filename: ds.keyFile.Name(), Offset: offset}
+		}
+	}
+	return nil
+}
+
+// readEntries returns the decoded entries of a key block, using the block cache. the buffer is used to read the block
+// if it is not cached, a nil buffer is allocated
+func (ds *diskSegment) readEntries(block int64, buffer []byte) ([]blockEntry, error) {
+	key := blockCacheKey{segment: ds.cacheID, block: block}
+	if entries, ok := ds.format.cache.get(key); ok {
+		return entries, nil
+	}
+	if buffer == nil {
+		buffer = make([]byte, ds.format.keyBlockSize)
+	}
+	err := ds.readBlock(buffer, block)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ds.decodeBlock(buffer)
+	if err != nil {
+		return nil, err
+	}
+	ds.format.cache.put(key, entries, entriesSize(entries))
+	return entries, nil
+}
+
+// firstKey returns the first key of a block, the buffer is used to read the block if there is no block cache. the
+// checksum of an uncompressed block is not verified, since only the start of the block is used
+func (ds *diskSegment) firstKey(block int64, buffer []byte) ([]byte, error) {
+	if ds.format.cache != nil {
+		entries, err := ds.readEntries(block, nil)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			return nil, &SegmentError{Filename: ds.keyFile.Name(), Err: SegmentCorrupted}
+		}
+		return entries[0].key, nil
+	}
+	var err error
+	if ds.format.compressor != nil {
+		err = ds.readBlock(buffer, block)
+	} else {
+		_, err = ds.keyFile.ReadAt(buffer, ds.blocksOffset+block*int64(ds.format.keyBlockSize))
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry, _, err := ds.decodeRecord(buffer, 0, nil)
+	if err == errEndOfBlock {
+		return nil, &SegmentError{Filename: ds.keyFile.Name(), Err: SegmentCorrupted}
 	}
-	return keyIndex
+	return entry.key, err
+}
+
+// readData reads a value from the data file, verifying the value checksum
+func (ds *diskSegment) readData(offset int64, length uint64) ([]byte, error) {
+	if !ds.format.checksums() {
+		buffer := make([]byte, length)
+		err := ds.readValues(buffer, offset)
+		return buffer, err
+	}
+	buffer := make([]byte, length+4)
+	err := ds.readValues(buffer, offset)
+	if err != nil {
+		return nil, err
+	}
+	checksum := binary.LittleEndian.Uint32(buffer[length:])
+	buffer = buffer[:length:length]
+	if crc32.Checksum(buffer, crcTable) != checksum {
+		return nil, &ErrCorruption{Filename: ds.dataFile.Name(), Offset: offset}
+	}
+	return buffer, nil
 }
 
 func (dsi *diskSegmentIterator) Next() (key []byte, value []byte, err error) {
@@ -156,6 +370,11 @@ func (dsi *diskSegmentIterator) Next() (key []byte, value []byte, err error) {
 	return dsi.key, dsi.data, dsi.err
 }
 
+func (dsi *diskSegmentIterator) nextRecord() (key []byte, value []byte, operand bool, err error) {
+	key, value, err = dsi.Next()
+	return key, value, dsi.operand, err
+}
+
 func (dsi *diskSegmentIterator) peekKey() ([]byte, error) {
 	if dsi.isValid {
 		return dsi.key, dsi.err
@@ -168,11 +387,14 @@ func (dsi *diskSegmentIterator) nextKeyValue() error {
 	if dsi.finished {
 		return EndOfIterator
 	}
+	if dsi.reverse {
+		return dsi.prevKeyValue()
+	}
 	var prevKey = dsi.key
 
 	for {
-		keylen := binary.LittleEndian.Uint16(dsi.buffer[dsi.bufferOffset:])
-		if keylen == endOfBlock {
+		entry, next, err := dsi.segment.decodeRecord(dsi.buffer, dsi.bufferOffset, prevKey)
+		if err == errEndOfBlock {
 			dsi.block++
 			if dsi.block == dsi.segment.keyBlocks {
 				dsi.finished = true
@@ -182,48 +404,35 @@ func (dsi *diskSegmentIterator) nextKeyValue() error {
 				dsi.isValid = true
 				return dsi.err
 			}
-			n, err := dsi.segment.keyFile.ReadAt(dsi.buffer, dsi.block*keyBlockSize)
+			err := dsi.segment.readBlock(dsi.buffer, dsi.block)
 			if err != nil {
-				return err
-			}
-			if n != keyBlockSize {
-				return errors.New(fmt.Sprint("did not read block size, read ", n))
+				return dsi.fail(err)
 			}
 			dsi.bufferOffset = 0
 			prevKey = nil
 			continue
 		}
-		prefixLen, compressedLen, err := decodeKeyLen(keylen)
 		if err != nil {
-			return err
+			return dsi.fail(err)
 		}
+		dsi.bufferOffset = next
 
-		dsi.bufferOffset += 2
-		key := dsi.buffer[dsi.bufferOffset : dsi.bufferOffset+int(compressedLen)]
-		dsi.bufferOffset += int(compressedLen)
-
-		key = decodeKey(key, prevKey, prefixLen)
-
-		dataoffset := binary.LittleEndian.Uint64(dsi.buffer[dsi.bufferOffset:])
-		dsi.bufferOffset += 8
-		datalen := binary.LittleEndian.Uint32(dsi.buffer[dsi.bufferOffset:])
-		dsi.bufferOffset += 4
-
+		key := entry.key
 		prevKey = key
 
-		if dsi.lower != nil {
-			if less(key, dsi.lower) {
+		if dsi.start != nil {
+			if less(dsi.segment.format.comparator, key, dsi.start) {
 				continue
 			}
-			if equal(key, dsi.lower) {
+			if equal(dsi.segment.format.comparator, key, dsi.start) {
 				goto found
 			}
 		}
 		if dsi.upper != nil {
-			if equal(key, dsi.upper) {
+			if equal(dsi.segment.format.comparator, key, dsi.upper) {
 				goto found
 			}
-			if !less(key, dsi.upper) {
+			if !less(dsi.segment.format.comparator, key, dsi.upper) {
 				dsi.finished = true
 				dsi.isValid = true
 				dsi.key = nil
@@ -234,57 +443,182 @@ func (dsi *diskSegmentIterator) nextKeyValue() error {
 		}
 	found:
 
-		if datalen == removedKeyLen {
+		dsi.operand = entry.record == recordOperand
+		if entry.record == recordRemoved {
 			dsi.data = nil
 		} else {
-			dsi.data = make([]byte, datalen)
-			_, err = dsi.segment.dataFile.ReadAt(dsi.data, int64(dataoffset))
+			dsi.data, err = dsi.segment.readData(entry.offset, entry.length)
+			if err != nil {
+				return dsi.fail(err)
+			}
 		}
 		dsi.key = key
 		dsi.isValid = true
-		return err
+		return nil
+	}
+}
+
+// prevKeyValue moves a reverse iterator to the previous key
+func (dsi *diskSegmentIterator) prevKeyValue() error {
+	for {
+		if dsi.entryIndex < 0 {
+			dsi.block--
+			if dsi.block < 0 {
+				return dsi.fail(EndOfIterator)
+			}
+			var err error
+			dsi.entries, err = dsi.segment.readEntries(dsi.block, dsi.buffer)
+			if err != nil {
+				return dsi.fail(err)
+			}
+			dsi.entryIndex = len(dsi.entries) - 1
+			continue
+		}
+		entry := dsi.entries[dsi.entryIndex]
+		dsi.entryIndex--
+
+		if dsi.start != nil && less(dsi.segment.format.comparator, dsi.start, entry.key) {
+			continue
+		}
+		if dsi.lower != nil && less(dsi.segment.format.comparator, entry.key, dsi.lower) {
+			return dsi.fail(EndOfIterator)
+		}
+
+		dsi.operand = entry.record == recordOperand
+		if entry.record == recordRemoved {
+			dsi.data = nil
+		} else {
+			data, err := dsi.segment.readData(entry.offset, entry.length)
+			if err != nil {
+				return dsi.fail(err)
+			}
+			dsi.data = data
+		}
+		dsi.key = entry.key
+		dsi.isValid = true
+		return nil
 	}
 }
 
+// Seek repositions the iterator at the first key >= key, or for a reverse iterator the last key <= key
+func (dsi *diskSegmentIterator) Seek(key []byte) error {
+	ds := dsi.segment
+
+	start := key
+	if dsi.reverse {
+		if start == nil || (dsi.upper != nil && less(ds.format.comparator, dsi.upper, start)) {
+			start = dsi.upper
+		}
+	} else {
+		if start == nil || (dsi.lower != nil && less(ds.format.comparator, start, dsi.lower)) {
+			start = dsi.lower
+		}
+	}
+
+	dsi.start = start
+	dsi.finished = false
+	dsi.isValid = false
+	dsi.key = nil
+	dsi.data = nil
+	dsi.err = nil
+
+	if len(ds.keyIndex) == 0 {
+		// the segment only has range tombstones
+		dsi.fail(EndOfIterator)
+		return nil
+	}
+
+	block := ds.keyBlocks - 1
+	if !dsi.reverse {
+		block = 0
+	}
+	if start != nil {
+		var err error
+		block, err = binarySearch0(ds, 0, ds.keyBlocks-1, start, dsi.buffer)
+		if err != nil {
+			return dsi.fail(err)
+		}
+	}
+
+	if !dsi.reverse && start != nil && dsi.upper != nil && less(ds.format.comparator, dsi.upper, start) {
+		dsi.fail(EndOfIterator)
+		return nil
+	}
+
+	if dsi.reverse {
+		// the block is read by prevKeyValue
+		dsi.block = block + 1
+		dsi.entries = nil
+		dsi.entryIndex = -1
+		return nil
+	}
+
+	err := ds.readBlock(dsi.buffer, block)
+	if err != nil {
+		return dsi.fail(err)
+	}
+	dsi.block = block
+	dsi.bufferOffset = 0
+	return nil
+}
+
+// fail ends the iteration with an error, which is returned by Next
+func (dsi *diskSegmentIterator) fail(err error) error {
+	dsi.finished = true
+	dsi.isValid = true
+	dsi.key = nil
+	dsi.data = nil
+	dsi.err = err
+	return err
+}
+
 func (ds *diskSegment) Put(key []byte, value []byte) error {
 	panic("disk segments are not mutable, unable to Put")
 }
 
 func (ds *diskSegment) Get(key []byte) ([]byte, error) {
-	offset, len, err := binarySearch(ds, key)
+	if ds.filter != nil && !ds.filter.mayContain(key) {
+		return nil, KeyNotFound
+	}
+	entry, err := binarySearch(ds, key)
 	if err == errKeyRemoved {
 		return nil, nil
 	}
 	if err != nil {
 		return nil, err
 	}
-	buffer := make([]byte, len)
-	_, err = ds.dataFile.ReadAt(buffer, offset)
-	if err != nil {
-		return nil, err
+	if entry.record == recordOperand {
+		operand, err := ds.readData(entry.offset, entry.length)
+		if err != nil {
+			return nil, err
+		}
+		return operand, errMergeOperand
 	}
-	return buffer, nil
+	return ds.readData(entry.offset, entry.length)
 }
 
-func binarySearch(ds *diskSegment, key []byte) (offset int64, length uint32, err error) {
-	buffer := make([]byte, maxKeySize+2) // enough room to read the starting key of each block
+func binarySearch(ds *diskSegment, key []byte) (blockEntry, error) {
+	var buffer []byte
+	if ds.format.cache == nil {
+		buffer = make([]byte, ds.format.keyBlockSize) // used to read the starting key of each block
+	}
 
 	var lowblock int64 = 0
 	highblock := ds.keyBlocks - 1
 
 	if ds.keyIndex != nil { // we have memory index, so narrow block range down
 		index := sort.Search(len(ds.keyIndex), func(i int) bool {
-			return less(key, ds.keyIndex[i])
+			return less(ds.format.comparator, key, ds.keyIndex[i])
 		})
 
 		if index == 0 {
-			return 0, 0, KeyNotFound
+			return blockEntry{}, KeyNotFound
 		}
 
 		index--
 
-		lowblock = int64(index * keyIndexInterval)
-		highblock = lowblock + int64(keyIndexInterval)
+		lowblock = int64(index * ds.format.keyIndexInterval)
+		highblock = lowblock + int64(ds.format.keyIndexInterval)
 
 		if highblock >= ds.keyBlocks {
 			highblock = ds.keyBlocks - 1
@@ -293,7 +627,7 @@ func binarySearch(ds *diskSegment, key []byte) (offset int64, length uint32, err
 
 	block, err := binarySearch0(ds, lowblock, highblock, key, buffer)
 	if err != nil {
-		return 0, 0, err
+		return blockEntry{}, err
 	}
 	return scanBlock(ds, block, key)
 }
@@ -302,10 +636,11 @@ func binarySearch(ds *diskSegment, key []byte) (offset int64, length uint32, err
 func binarySearch0(ds *diskSegment, lowBlock int64, highBlock int64, key []byte, buffer []byte) (int64, error) {
 	if highBlock-lowBlock <= 1 {
 		// the key is either in low block or high block, or does not exist, so check high block
-		ds.keyFile.ReadAt(buffer, highBlock*keyBlockSize)
-		keylen := binary.LittleEndian.Uint16(buffer)
-		skey := buffer[2 : 2+keylen]
-		if less(key, skey) {
+		skey, err := ds.firstKey(highBlock, buffer)
+		if err != nil {
+			return 0, err
+		}
+		if less(ds.format.comparator, key, skey) {
 			return lowBlock, nil
 		} else {
 			return highBlock, nil
@@ -314,91 +649,220 @@ func binarySearch0(ds *diskSegment, lowBlock int64, highBlock int64, key []byte,
 
 	block := (highBlock-lowBlock)/2 + lowBlock
 
-	ds.keyFile.ReadAt(buffer, block*keyBlockSize)
-	keylen := binary.LittleEndian.Uint16(buffer)
-	skey := buffer[2 : 2+keylen]
+	skey, err := ds.firstKey(block, buffer)
+	if err != nil {
+		return 0, err
+	}
 
-	if less(key, skey) {
+	if less(ds.format.comparator, key, skey) {
 		return binarySearch0(ds, lowBlock, block, key, buffer)
 	} else {
 		return binarySearch0(ds, block, highBlock, key, buffer)
 	}
 }
 
-func scanBlock(ds *diskSegment, block int64, key []byte) (offset int64, len uint32, err error) {
-	buffer := make([]byte, keyBlockSize)
-
-	_, err = ds.keyFile.ReadAt(buffer, block*keyBlockSize)
+// scanBlock finds a key in the entries of a block, the error is errKeyRemoved if the key is removed
+func scanBlock(ds *diskSegment, block int64, key []byte) (blockEntry, error) {
+	entries, err := ds.readEntries(block, nil)
 	if err != nil {
-		return 0, 0, err
+		return blockEntry{}, err
 	}
+	index := sort.Search(len(entries), func(i int) bool {
+		return !less(ds.format.comparator, entries[i].key, key)
+	})
+	if index == len(entries) || !equal(ds.format.comparator, entries[index].key, key) {
+		return blockEntry{}, KeyNotFound
+	}
+	entry := entries[index]
+	if entry.record == recordRemoved {
+		return entry, errKeyRemoved
+	}
+	return entry, nil
+}
 
-	index := 0
-	var prevKey []byte = nil
-	for {
-		keylen := binary.LittleEndian.Uint16(buffer[index:])
-		if keylen == endOfBlock {
-			return 0, 0, KeyNotFound
-		}
+func (ds *diskSegment) Remove(key []byte) ([]byte, error) {
+	panic("disk segments are immutable, unable to Remove")
+}
 
-		var compressedLen = keylen
-		var prefixLen = 0
+func (ds *diskSegment) Merge(key []byte, operand []byte, operator MergeOperator) error {
+	panic("disk segments are immutable, unable to Merge")
+}
 
-		if keylen&compressedBit != 0 {
-			prefixLen = int((keylen >> 8) & maxPrefixLen)
-			compressedLen = keylen & maxCompressedLen
-		}
+func (ds *diskSegment) DeleteRange(lower []byte, upper []byte) error {
+	panic("disk segments are immutable, unable to DeleteRange")
+}
 
-		endkey := index + 2 + int(compressedLen)
-		_key := buffer[index+2 : endkey]
+func (ds *diskSegment) deletedRanges() []keyRange {
+	return ds.deleted
+}
 
-		if prefixLen > 0 {
-			_key = append(prevKey[:prefixLen], _key...)
-		}
+func (ds *diskSegment) bounds() (keyRange, bool) {
+	return ds.keyBounds, len(ds.keyIndex) > 0
+}
 
-		prevKey = _key
+func (ds *diskSegment) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
+	buffer := make([]byte, ds.format.keyBlockSize)
+	dsi := &diskSegmentIterator{segment: ds, lower: lower, upper: upper, buffer: buffer}
+	err := dsi.Seek(lower)
+	if err != nil {
+		return nil, err
+	}
+	return dsi, nil
+}
 
-		if bytes.Equal(_key, key) {
-			offset = int64(binary.LittleEndian.Uint64(buffer[endkey:]))
-			len = binary.LittleEndian.Uint32(buffer[endkey+8:])
-			if len == removedKeyLen {
-				err = errKeyRemoved
-			}
-			return
+func (ds *diskSegment) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	buffer := make([]byte, ds.format.keyBlockSize)
+	dsi := &diskSegmentIterator{segment: ds, lower: lower, upper: upper, buffer: buffer, reverse: true}
+	err := dsi.Seek(upper)
+	if err != nil {
+		return nil, err
+	}
+	return dsi, nil
+}
+
+// decodeBlock returns the entries of a key block
+func (ds *diskSegment) decodeBlock(buffer []byte) ([]blockEntry, error) {
+	var entries []blockEntry
+	var prevKey []byte
+
+	index := 0
+	for {
+		entry, next, err := ds.decodeRecord(buffer, index, prevKey)
+		if err == errEndOfBlock {
+			return entries, nil
 		}
-		if !less(_key, key) {
-			return 0, 0, KeyNotFound
+		if err != nil {
+			return nil, err
 		}
-		index = endkey + 12
+		entries = append(entries, entry)
+		prevKey = entry.key
+		index = next
 	}
 }
 
-func (ds *diskSegment) Remove(key []byte) ([]byte, error) {
-	panic("disk segments are immutable, unable to Remove")
-}
+// decodeRecord decodes the key record at index in a key block, returning the index of the next record. the error is
+// errEndOfBlock at the end of the block
+func (ds *diskSegment) decodeRecord(buffer []byte, index int, prevKey []byte) (blockEntry, int, error) {
+	corrupted := &SegmentError{Filename: ds.keyFile.Name(), Err: SegmentCorrupted}
 
-func (ds *diskSegment) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
-	buffer := make([]byte, keyBlockSize)
-	var block int64 = 0
-	if lower != nil {
-		startBlock, err := binarySearch0(ds, 0, ds.keyBlocks-1, lower, buffer)
+	if ds.format.version < segmentVersion3 {
+		if index+2 > len(buffer) {
+			return blockEntry{}, 0, corrupted
+		}
+		keylen := binary.LittleEndian.Uint16(buffer[index:])
+		if keylen == endOfBlock {
+			return blockEntry{}, 0, errEndOfBlock
+		}
+		prefixLen, compressedLen, err := decodeKeyLen(keylen)
 		if err != nil {
-			return nil, err
+			return blockEntry{}, 0, corrupted
+		}
+		index += 2
+		if index+int(compressedLen)+12 > len(buffer) || len(prevKey) < int(prefixLen) {
+			return blockEntry{}, 0, corrupted
 		}
-		block = startBlock
+		key := decodeKey(buffer[index:index+int(compressedLen)], prevKey, int(prefixLen))
+		index += int(compressedLen)
+
+		offset := int64(binary.LittleEndian.Uint64(buffer[index:]))
+		index += 8
+		length := binary.LittleEndian.Uint32(buffer[index:])
+		index += 4
+
+		entry := blockEntry{key: key, record: recordValue, offset: offset, length: uint64(length &^ operandBit)}
+		if length == removedKeyLen {
+			entry.record = recordRemoved
+			entry.length = 0
+		} else if length&operandBit != 0 {
+			entry.record = recordOperand
+		}
+		return entry, index, nil
 	}
-	n, err := ds.keyFile.ReadAt(buffer, block*keyBlockSize)
-	if err != nil {
-		return nil, err
+
+	if index >= len(buffer) {
+		return blockEntry{}, 0, corrupted
+	}
+	entry := blockEntry{record: buffer[index]}
+	index++
+	if entry.record == recordEnd {
+		return blockEntry{}, 0, errEndOfBlock
+	}
+	if entry.record > recordOperand {
+		return blockEntry{}, 0, corrupted
+	}
+	prefixLen, n := binary.Uvarint(buffer[index:])
+	if n <= 0 {
+		return blockEntry{}, 0, corrupted
+	}
+	index += n
+	keyLen, n := binary.Uvarint(buffer[index:])
+	if n <= 0 {
+		return blockEntry{}, 0, corrupted
+	}
+	index += n
+	if prefixLen+keyLen == 0 || keyLen > uint64(len(buffer)-index) || prefixLen > uint64(len(prevKey)) {
+		return blockEntry{}, 0, corrupted
+	}
+	entry.key = decodeKey(buffer[index:index+int(keyLen)], prevKey, int(prefixLen))
+	index += int(keyLen)
+	if entry.record == recordRemoved {
+		return entry, index, nil
+	}
+	offset, n := binary.Uvarint(buffer[index:])
+	if n <= 0 {
+		return blockEntry{}, 0, corrupted
 	}
-	if n != keyBlockSize {
-		return nil, errors.New(fmt.Sprint("did not read block size ", n))
+	index += n
+	entry.length, n = binary.Uvarint(buffer[index:])
+	if n <= 0 {
+		return blockEntry{}, 0, corrupted
 	}
-	return &diskSegmentIterator{segment: ds, lower: lower, upper: upper, buffer: buffer, block: block}, nil
+	entry.offset = int64(offset)
+	return entry, index + n, nil
 }
 
+// Close releases the reference held by the creator of the segment
 func (ds *diskSegment) Close() error {
+	return ds.release()
+}
+
+func (ds *diskSegment) acquire() {
+	atomic.AddInt32(&ds.refs, 1)
+}
+
+// release a reference to the segment, closing the segment if it was the last reference
+func (ds *diskSegment) release() error {
+	if atomic.AddInt32(&ds.refs, -1) > 0 {
+		return nil
+	}
+	ds.format.cache.removeSegment(ds.cacheID)
 	err0 := ds.keyFile.Close()
 	err1 := ds.dataFile.Close()
-	return errn(err0, err1)
+	if !ds.obsolete {
+		return errn(err0, err1)
+	}
+	err2 := os.Remove(ds.keyFile.Name())
+	err3 := os.Remove(ds.dataFile.Name())
+	return errn(err0, err1, err2, err3)
+}
+
+// acquireSegments acquires a reference to each of the disk segments. the caller must hold the table lock
+func acquireSegments(segments []segment) {
+	for _, s := range segments {
+		if ds, ok := s.(*diskSegment); ok {
+			ds.acquire()
+		}
+	}
+}
+
+// releaseSegments releases the references acquired by acquireSegments. an error removing an obsolete segment is
+// not fatal, the files are no longer in the manifest so they are moved to the quarantine directory on the next open
+func releaseSegments(segments []segment) error {
+	var err error
+	for _, s := range segments {
+		if ds, ok := s.(*diskSegment); ok {
+			err = errn(err, ds.release())
+		}
+	}
+	return err
 }
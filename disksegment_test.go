@@ -2,9 +2,12 @@ package keydb
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestDiskSegment(t *testing.T) {
@@ -18,7 +21,7 @@ func TestDiskSegment(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, nil)
 
 	itr, err = ds.Lookup(nil, nil)
 	if err != nil {
@@ -75,7 +78,7 @@ func TestLargeDiskSegment(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, nil)
 
 	itr, err = ds.Lookup(nil, nil)
 	count := 0
@@ -141,7 +144,7 @@ func TestEmptySegment(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, nil)
 
 	itr, err = ds.Lookup(nil, nil)
 	count := 0
@@ -157,3 +160,487 @@ func TestEmptySegment(t *testing.T) {
 		t.Fatal("incorrect count", count)
 	}
 }
+
+func TestSegmentChecksums(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	for i := 0; i < 1000; i++ {
+		m.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	itr, _ := m.Lookup(nil, nil)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+
+	// damage a value, and the second key block
+	data, _ := ioutil.ReadFile("test/datafile")
+	data[0] ^= 0xFF
+	ioutil.WriteFile("test/datafile", data, os.ModePerm)
+	keys, _ := ioutil.ReadFile("test/keyfile")
+	keys[segmentHeaderSize+defaultKeyBlockSize+10] ^= 0xFF
+	ioutil.WriteFile("test/keyfile", keys, os.ModePerm)
+
+	ds, err = newDiskSegment("test/keyfile", "test/datafile", defaultSegmentFormat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	_, err = ds.Get([]byte("mykey0"))
+	var ec *ErrCorruption
+	if !errors.As(err, &ec) || ec.Filename != "test/datafile" || ec.Offset != 0 {
+		t.Fatal("value should fail checksum", err)
+	}
+
+	itr, _ = ds.Lookup([]byte("mykey1"), nil)
+	for {
+		_, _, err = itr.Next()
+		if err != nil {
+			break
+		}
+	}
+	if !errors.As(err, &ec) || ec.Filename != "test/keyfile" || ec.Offset != segmentHeaderSize+defaultKeyBlockSize {
+		t.Fatal("key block should fail checksum", err)
+	}
+	if !errors.Is(err, SegmentCorrupted) {
+		t.Fatal("corruption should be reported as SegmentCorrupted", err)
+	}
+}
+
+func TestVersion1Segment(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	m.Put([]byte("mykey"), []byte("myvalue"))
+	m.Put([]byte("mykey2"), []byte("myvalue2"))
+	itr, _ := m.Lookup(nil, nil)
+
+	format := defaultSegmentFormat
+	format.version = segmentVersion1
+	format.bloomBitsPerKey = 0
+
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, format, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	value, err := ds.Get([]byte("mykey2"))
+	if err != nil || !bytes.Equal(value, []byte("myvalue2")) {
+		t.Fatal("incorrect value", err)
+	}
+	if fi, _ := os.Stat("test/datafile"); fi.Size() != 15 {
+		t.Fatal("version 1 values should not have checksums")
+	}
+}
+
+func TestBloomFilter(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	for i := 0; i < 10000; i++ {
+		m.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	m.Remove([]byte("removed"))
+	itr, _ := m.Lookup(nil, nil)
+
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	filter := ds.(*diskSegment).filter
+	if filter == nil {
+		t.Fatal("segment should have a bloom filter")
+	}
+	for i := 0; i < 10000; i++ {
+		if !filter.mayContain([]byte(fmt.Sprint("mykey", i))) {
+			t.Fatal("filter should contain key", i)
+		}
+	}
+	if !filter.mayContain([]byte("removed")) {
+		t.Fatal("filter should contain removed keys")
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if filter.mayContain([]byte(fmt.Sprint("missing", i))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Fatal("too many false positives", falsePositives)
+	}
+
+	value, err := ds.Get([]byte("mykey500"))
+	if err != nil || !bytes.Equal(value, []byte("myvalue500")) {
+		t.Fatal("incorrect value", err)
+	}
+	value, err = ds.Get([]byte("removed"))
+	if err != nil || value != nil {
+		t.Fatal("removed key should be found as removed", err)
+	}
+	_, err = ds.Get([]byte("missing"))
+	if err != KeyNotFound {
+		t.Fatal("key should not be found", err)
+	}
+}
+
+func TestDiskSegmentReverse(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	for i := 0; i < 10000; i++ {
+		m.Put([]byte(fmt.Sprintf("mykey%05d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	itr, _ := m.Lookup(nil, nil)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	itr, err = ds.LookupReverse(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 9999; i >= 0; i-- {
+		key, value, err := itr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(key) != fmt.Sprintf("mykey%05d", i) || string(value) != fmt.Sprint("myvalue", i) {
+			t.Fatal("incorrect key/value", string(key), string(value))
+		}
+	}
+	_, _, err = itr.Next()
+	if err != EndOfIterator {
+		t.Fatal("iterator should be exhausted", err)
+	}
+
+	itr, err = ds.LookupReverse([]byte("mykey01000"), []byte("mykey05000x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, err := itr.Next()
+	if err != nil || string(key) != "mykey05000" {
+		t.Fatal("incorrect first key", string(key), err)
+	}
+	err = itr.Seek([]byte("mykey02000x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for {
+		key, _, err = itr.Next()
+		if err != nil {
+			break
+		}
+		if count == 0 && string(key) != "mykey02000" {
+			t.Fatal("incorrect key after seek", string(key))
+		}
+		count++
+	}
+	if count != 1001 {
+		t.Fatal("incorrect count", count)
+	}
+
+	itr, err = ds.Lookup([]byte("mykey01000"), []byte("mykey05000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = itr.Seek([]byte("mykey04999"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _ = itr.Next()
+	key2, _, _ := itr.Next()
+	_, _, err = itr.Next()
+	if string(key) != "mykey04999" || string(key2) != "mykey05000" || err != EndOfIterator {
+		t.Fatal("incorrect keys after seek", string(key), string(key2), err)
+	}
+	err = itr.Seek(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _, _ = itr.Next()
+	if string(key) != "mykey01000" {
+		t.Fatal("seek should reposition to the start of the range", string(key))
+	}
+}
+
+func TestBlockCache(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	for i := 0; i < 10000; i++ {
+		m.Put([]byte(fmt.Sprintf("mykey%05d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	m.Remove([]byte("removed"))
+	itr, _ := m.Lookup(nil, nil)
+
+	format := defaultSegmentFormat
+	format.cache = newBlockCache(100 * 1024)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, format, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for pass := 0; pass < 2; pass++ {
+		for i := 0; i < 10000; i += 7 {
+			value, err := ds.Get([]byte(fmt.Sprintf("mykey%05d", i)))
+			if err != nil || !bytes.Equal(value, []byte(fmt.Sprint("myvalue", i))) {
+				t.Fatal("incorrect value", i, err)
+			}
+		}
+	}
+	value, err := ds.Get([]byte("removed"))
+	if err != nil || value != nil {
+		t.Fatal("removed key should be found as removed", err)
+	}
+
+	stats := format.cache.stats()
+	if stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatal("cache should have hits and misses", stats)
+	}
+	if int64(stats.Blocks) >= ds.(*diskSegment).keyBlocks || stats.Size > stats.Capacity {
+		t.Fatal("cache should be bounded", stats)
+	}
+	if stats.Size <= int64(stats.Blocks*format.keyBlockSize) {
+		t.Fatal("blocks should be charged their decoded size", stats)
+	}
+
+	itr, err = ds.LookupReverse([]byte("mykey05000"), []byte("mykey05100"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 5100; i >= 5000; i-- {
+		key, _, err := itr.Next()
+		if err != nil || !bytes.Equal(key, []byte(fmt.Sprintf("mykey%05d", i))) {
+			t.Fatal("incorrect key", string(key), err)
+		}
+	}
+
+	ds.Close()
+	if stats := format.cache.stats(); stats.Blocks != 0 || stats.Size != 0 {
+		t.Fatal("closing the segment should remove its blocks", stats)
+	}
+}
+
+func TestCompressedSegment(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	for i := 0; i < 10000; i++ {
+		m.Put([]byte(fmt.Sprintf("mykey%05d", i)), []byte(fmt.Sprintf("myvalue%0100d", i)))
+	}
+	m.Remove([]byte("removed"))
+	m.Put([]byte("zlarge"), bytes.Repeat([]byte("large"), 10000))
+
+	itr, _ := m.Lookup(nil, nil)
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+	keySize, dataSize := fileSize("test/keyfile"), fileSize("test/datafile")
+
+	compressor := &countingCompressor{Compressor: FlateCompressor}
+	format := defaultSegmentFormat
+	format.compressor = compressor
+	itr, _ = m.Lookup(nil, nil)
+	ds, err = writeAndLoadSegment("test/keyfile", "test/datafile", itr, format, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	if fileSize("test/keyfile")*2 > keySize || fileSize("test/datafile")*2 > dataSize {
+		t.Fatal("segment should be compressed", keySize, dataSize, fileSize("test/keyfile"), fileSize("test/datafile"))
+	}
+
+	for i := 0; i < 10000; i += 7 {
+		value, err := ds.Get([]byte(fmt.Sprintf("mykey%05d", i)))
+		if err != nil || !bytes.Equal(value, []byte(fmt.Sprintf("myvalue%0100d", i))) {
+			t.Fatal("incorrect value", i, err)
+		}
+	}
+	value, err := ds.Get([]byte("zlarge"))
+	if err != nil || !bytes.Equal(value, bytes.Repeat([]byte("large"), 10000)) {
+		t.Fatal("incorrect large value", err)
+	}
+	value, err = ds.Get([]byte("removed"))
+	if err != nil || value != nil {
+		t.Fatal("removed key should be found as removed", err)
+	}
+
+	count := 0
+	compressor.decompressed = 0
+	itr, _ = ds.Lookup(nil, nil)
+	for {
+		_, _, err := itr.Next()
+		if err == EndOfIterator {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+	}
+	if count != 10002 {
+		t.Fatal("incorrect count", count)
+	}
+	// a scan decompresses every block once
+	blocks := ds.(*diskSegment).keyBlocks + int64(len(ds.(*diskSegment).dataOffsets)-1)
+	if int64(compressor.decompressed) > blocks {
+		t.Fatal("blocks decompressed more than once", compressor.decompressed, blocks)
+	}
+	itr, _ = ds.LookupReverse(nil, []byte("mykey05000"))
+	key, _, err := itr.Next()
+	if err != nil || !bytes.Equal(key, []byte("mykey05000")) {
+		t.Fatal("incorrect key", string(key), err)
+	}
+
+	// the segment is not readable without its compressor
+	format.compressor = nil
+	_, err = newDiskSegment("test/keyfile", "test/datafile", format, nil)
+	if !errors.Is(err, SegmentCorrupted) {
+		t.Fatal("compressed segment should not be readable as uncompressed", err)
+	}
+}
+
+// countingCompressor counts the blocks decompressed
+type countingCompressor struct {
+	Compressor
+	decompressed int
+}
+
+func (c *countingCompressor) Decompress(dst []byte, src []byte) error {
+	c.decompressed++
+	return c.Compressor.Decompress(dst, src)
+}
+
+func fileSize(filename string) int64 {
+	fi, err := os.Stat(filename)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+func TestSegmentVersions(t *testing.T) {
+	for _, version := range []int{segmentVersion2, segmentVersion3, segmentVersion4} {
+		os.RemoveAll("test")
+		os.Mkdir("test", os.ModePerm)
+		m := newMemorySegment()
+		for i := 0; i < 1000; i++ {
+			m.Put([]byte(fmt.Sprintf("mykey%05d", i)), []byte(fmt.Sprint("myvalue", i)))
+		}
+		m.Remove([]byte("removed"))
+		if version >= segmentVersion3 {
+			m.Put(bytes.Repeat([]byte("large"), 2000), []byte("largevalue"))
+		}
+		itr, _ := m.Lookup(nil, nil)
+
+		format := defaultSegmentFormat
+		format.version = version
+		ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, format, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version >= segmentVersion3 && ds.(*diskSegment).format.keyBlockSize != 4*defaultKeyBlockSize {
+			t.Fatal("segment should be written with larger key blocks", ds.(*diskSegment).format.keyBlockSize)
+		}
+		value, err := ds.Get([]byte("mykey00500"))
+		if err != nil || !bytes.Equal(value, []byte("myvalue500")) {
+			t.Fatal("incorrect value", version, err)
+		}
+		value, err = ds.Get([]byte("removed"))
+		if err != nil || value != nil {
+			t.Fatal("removed key should be found as removed", version, err)
+		}
+		count := 0
+		itr, _ = ds.Lookup(nil, nil)
+		for {
+			_, _, err := itr.Next()
+			if err == EndOfIterator {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			count++
+		}
+		expected := 1001
+		if version >= segmentVersion3 {
+			expected++
+		}
+		if count != expected {
+			t.Fatal("incorrect count", version, count)
+		}
+		ds.Close()
+	}
+}
+
+func TestSegmentFooter(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m := newMemorySegment()
+	for i := 0; i < 10000; i++ {
+		m.Put([]byte(fmt.Sprintf("mykey%05d", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	m.Remove([]byte("mykey00010"))
+	m.Remove([]byte("mykey00020"))
+	itr, _ := m.Lookup(nil, nil)
+
+	ds, err := writeAndLoadSegment("test/keyfile", "test/datafile", itr, defaultSegmentFormat, nil, []uint64{3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyIndex := ds.(*diskSegment).keyIndex
+	ds.Close()
+
+	before := time.Now()
+	ds, err = newDiskSegment("test/keyfile", "test/datafile", defaultSegmentFormat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	footer := ds.(*diskSegment).footer
+	if string(footer.firstKey) != "mykey00000" || string(footer.lastKey) != "mykey09999" {
+		t.Fatal("incorrect key range", string(footer.firstKey), string(footer.lastKey))
+	}
+	if footer.entries != 10000 || footer.tombstones != 2 {
+		t.Fatal("incorrect counts", footer.entries, footer.tombstones)
+	}
+	if len(footer.sources) != 2 || footer.sources[0] != 3 || footer.sources[1] != 4 {
+		t.Fatal("incorrect sources", footer.sources)
+	}
+	if footer.created.After(before) || before.Sub(footer.created) > time.Minute {
+		t.Fatal("incorrect creation time", footer.created)
+	}
+	if len(keyIndex) < 2 || len(ds.(*diskSegment).keyIndex) != len(keyIndex) {
+		t.Fatal("key index should be loaded from the footer", len(keyIndex))
+	}
+	for i, key := range keyIndex {
+		if !bytes.Equal(ds.(*diskSegment).keyIndex[i], key) {
+			t.Fatal("incorrect key index", i)
+		}
+	}
+	value, err := ds.Get([]byte("mykey09999"))
+	if err != nil || !bytes.Equal(value, []byte("myvalue9999")) {
+		t.Fatal("incorrect value", err)
+	}
+
+	// a damaged footer is detected
+	keys, _ := ioutil.ReadFile("test/keyfile")
+	keys[len(keys)-segmentTrailerSize-1] ^= 0xFF
+	ioutil.WriteFile("test/keyfile", keys, os.ModePerm)
+	_, err = newDiskSegment("test/keyfile", "test/datafile", defaultSegmentFormat, nil)
+	if !errors.Is(err, SegmentCorrupted) {
+		t.Fatal("footer should fail checksum", err)
+	}
+}
@@ -1,9 +1,12 @@
 package keydb
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var KeyNotFound = errors.New("key not found")
-var KeyTooLong = errors.New("key too long, max 1024")
+var KeyTooLong = errors.New("key too long, see MaxKeyLength")
 var EmptyKey = errors.New("key is empty")
 var TransactionClosed = errors.New("transaction closed")
 var DatabaseClosed = errors.New("database closed")
@@ -14,6 +17,49 @@ var NotADirectory = errors.New("path is not a directory")
 var NotValidDatabase = errors.New("path is not a valid database")
 var EndOfIterator = errors.New("end of iterator")
 var ReadOnlySegment = errors.New("read only segment")
+var SegmentMissing = errors.New("segment file missing")
+var SegmentCorrupted = errors.New("segment file corrupted")
+var InvalidOptions = errors.New("invalid options")
+var TableNotInTransaction = errors.New("table not in transaction")
+var ErrConflict = errors.New("transaction conflicts with a concurrent commit")
+var TableNotFound = errors.New("table not found")
+var TableExists = errors.New("table already exists")
+var TableInUse = errors.New("table has open transactions")
+var NoMergeOperator = errors.New("no merge operator for table")
+var InvalidOperand = errors.New("invalid merge operand")
+var ComparatorMismatch = errors.New("table was written with a different comparator")
+var UnknownCompressor = errors.New("segment was written with an unknown compressor")
+
+// SegmentError is returned when a segment file listed in the manifest cannot be used. Err is SegmentMissing,
+// SegmentCorrupted or the underlying i/o error
+type SegmentError struct {
+	Filename string
+	Err      error
+}
+
+func (e *SegmentError) Error() string {
+	return "segment " + e.Filename + ": " + e.Err.Error()
+}
+
+func (e *SegmentError) Unwrap() error {
+	return e.Err
+}
+
+// ErrCorruption is returned when data read from a segment file does not match its checksum. Offset is the
+// position in the file of the key block or value that failed verification
+type ErrCorruption struct {
+	Filename string
+	Offset   int64
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprint("checksum mismatch in ", e.Filename, " at offset ", e.Offset)
+}
+
+// Is reports corruption errors as SegmentCorrupted
+func (e *ErrCorruption) Is(target error) bool {
+	return target == SegmentCorrupted
+}
 
 // returns the first non-nil error
 func errn(errs ...error) error {
@@ -0,0 +1,388 @@
+package keydb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// the manifest records the live segments of every table, in chronological order, along with the next segment id.
+// it is rewritten atomically whenever a segment is written or segments are merged, and it is the only record of which
+// segment files are part of the database. segment files not listed in the manifest are left over from an interrupted
+// write or merge, and are ignored.
+
+const manifestFilename = "manifest"
+const manifestVersion = 1
+
+var errUnsupportedManifest = errors.New("unsupported manifest version")
+
+type manifest struct {
+	sync.Mutex `json:"-"`
+	path       string
+
+	Version       int                       `json:"version"`
+	NextSegmentID uint64                    `json:"nextSegmentID"`
+	Tables        map[string]*manifestTable `json:"tables"`
+	// the log sequence number of the last commit whose disk segments are recorded, see wal.go
+	LogSequence uint64 `json:"logSequence,omitempty"`
+	// the log sequence number of the last table record applied
+	TableSequence uint64 `json:"tableSequence,omitempty"`
+}
+
+type manifestTable struct {
+	Segments []manifestSegment `json:"segments"`
+	// the name of the comparator the table was written with, empty for tables written before comparators were
+	// recorded, which are bytewise
+	Comparator string `json:"comparator,omitempty"`
+}
+
+// manifestSegment identifies the files of a segment, and the format settings needed to read them. the files are
+// named base.keys.id and base.data.id, where base is the table name unless the segment was created with a different name
+type manifestSegment struct {
+	ID           uint64 `json:"id"`
+	Base         string `json:"base,omitempty"`
+	Version      int    `json:"version,omitempty"`
+	KeyBlockSize int    `json:"keyBlockSize,omitempty"`
+	// zero if the segment has no bloom filter
+	BloomBitsPerKey int `json:"bloomBitsPerKey,omitempty"`
+	// the name of the compressor, empty if the segment is not compressed
+	Compression string `json:"compression,omitempty"`
+	// the range tombstones of the segment
+	DeletedRanges []manifestRange `json:"deletedRanges,omitempty"`
+}
+
+// manifestRange is a range tombstone, a missing lower or upper is unbounded
+type manifestRange struct {
+	Lower []byte `json:"lower,omitempty"`
+	Upper []byte `json:"upper,omitempty"`
+}
+
+// readManifest reads the manifest of the database. if the database predates the manifest, one is
+// built from the segment files in the directory
+func readManifest(dbpath string) (*manifest, error) {
+	filename := filepath.Join(dbpath, manifestFilename)
+
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		m, err := scanSegments(dbpath)
+		if err != nil {
+			return nil, err
+		}
+		return m, m.write()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{path: filename}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, errors.New("unable to read manifest: " + err.Error())
+	}
+	if m.Version != manifestVersion {
+		return nil, errUnsupportedManifest
+	}
+	if m.Tables == nil {
+		m.Tables = make(map[string]*manifestTable)
+	}
+	return m, nil
+}
+
+// scanSegments builds a manifest from the segment files in the database directory, ordering each table's
+// segments by id. the format of segments with a header is read from the header
+func scanSegments(dbpath string) (*manifest, error) {
+	m := &manifest{path: filepath.Join(dbpath, manifestFilename), Version: manifestVersion}
+	m.Tables = make(map[string]*manifestTable)
+
+	files, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tmp") {
+			continue
+		}
+		index := strings.Index(file.Name(), ".keys.")
+		if index < 0 {
+			continue
+		}
+		base := file.Name()[:index]
+		table := base
+		if merged := strings.Index(base, ".merged."); merged >= 0 {
+			table = base[:merged]
+		}
+		id := getSegmentID(file.Name())
+
+		mt, ok := m.Tables[table]
+		if !ok {
+			mt = &manifestTable{}
+			m.Tables[table] = mt
+		}
+		ms := manifestSegment{ID: id}
+		if header, ok := readSegmentHeader(filepath.Join(dbpath, file.Name())); ok {
+			ms.Version, ms.KeyBlockSize, ms.Compression = header.version, header.keyBlockSize, header.compressor
+		}
+		if base != table {
+			ms.Base = base
+		}
+		mt.Segments = append(mt.Segments, ms)
+
+		if id >= m.NextSegmentID {
+			m.NextSegmentID = id + 1
+		}
+	}
+	for _, mt := range m.Tables {
+		sort.Slice(mt.Segments, func(i, j int) bool {
+			return mt.Segments[i].ID < mt.Segments[j].ID
+		})
+	}
+	return m, nil
+}
+
+// write atomically replaces the manifest file. the caller must hold the manifest lock, or have exclusive access
+func (m *manifest) write() error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := m.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errn(err, f.Close())
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, m.path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(m.path))
+}
+
+// segments returns the live segments for a table
+func (m *manifest) segments(table string) []manifestSegment {
+	m.Lock()
+	defer m.Unlock()
+
+	mt, ok := m.Tables[table]
+	if !ok {
+		return nil
+	}
+	return append([]manifestSegment(nil), mt.Segments...)
+}
+
+// updateManifest records the current disk segments of the tables in the manifest. the caller must hold the table
+// locks, so that the manifest is updated in the same order as the tables
+func updateManifest(db *Database, tables ...*internalTable) error {
+	return updateManifestFlushed(db, 0, tables...)
+}
+
+// updateManifestFlushed is updateManifest for the tables of the commit with the log sequence number, which is
+// recorded along with its disk segments. a zero seq leaves the log sequence number unchanged
+func updateManifestFlushed(db *Database, seq uint64, tables ...*internalTable) error {
+	m := db.manifest
+	m.Lock()
+	defer m.Unlock()
+
+	if seq != 0 {
+		m.LogSequence = seq
+	}
+	for _, table := range tables {
+		m.Tables[table.name] = &manifestTable{Segments: manifestSegments(table), Comparator: db.options.comparator(table.name).Name()}
+	}
+	m.NextSegmentID = atomic.LoadUint64(&db.nextSegID)
+
+	return m.write()
+}
+
+// manifestSegments returns the manifest entries for the disk segments of a table
+func manifestSegments(table *internalTable) []manifestSegment {
+	var segments []manifestSegment
+	for _, s := range table.segments {
+		if ds, ok := s.(*diskSegment); ok {
+			ms := manifestSegment{ID: ds.id, Version: ds.format.version, KeyBlockSize: ds.format.keyBlockSize, BloomBitsPerKey: ds.format.bloomBitsPerKey}
+			if ds.format.compressor != nil {
+				ms.Compression = ds.format.compressor.Name()
+			}
+			for _, r := range ds.deleted {
+				ms.DeletedRanges = append(ms.DeletedRanges, manifestRange{Lower: r.lower, Upper: r.upper})
+			}
+			if base := segmentBase(ds.keyFile.Name()); base != table.name {
+				ms.Base = base
+			}
+			segments = append(segments, ms)
+		}
+	}
+	return segments
+}
+
+// checkComparators returns ComparatorMismatch if a table was written with a different comparator than the
+// options have for it
+func (m *manifest) checkComparators(options Options) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for table, mt := range m.Tables {
+		name := mt.Comparator
+		if name == "" {
+			name = BytewiseComparator.Name()
+		}
+		if name != options.comparator(table).Name() {
+			return fmt.Errorf("%w, table %s uses %s", ComparatorMismatch, table, name)
+		}
+	}
+	return nil
+}
+
+// checkCompressors returns UnknownCompressor if a segment was written with a compressor that the options do not have
+func (m *manifest) checkCompressors(options Options) error {
+	m.Lock()
+	defer m.Unlock()
+
+	for table, mt := range m.Tables {
+		for _, ms := range mt.Segments {
+			if ms.Compression != "" && options.compressorNamed(ms.Compression) == nil {
+				return fmt.Errorf("%w, table %s uses %s", UnknownCompressor, table, ms.Compression)
+			}
+		}
+	}
+	return nil
+}
+
+// tableNames returns the names of the tables in the manifest
+func (m *manifest) tableNames() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	var names []string
+	for name := range m.Tables {
+		names = append(names, name)
+	}
+	return names
+}
+
+func (m *manifest) hasTable(table string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := m.Tables[table]
+	return ok
+}
+
+// dropTable removes a table from the manifest, returning the segments it had. if truncate is true the table
+// remains in the manifest with no segments. seq is the log sequence number of the table record
+func (m *manifest) dropTable(table string, truncate bool, seq uint64) ([]manifestSegment, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.TableSequence = seq
+	mt, ok := m.Tables[table]
+	if !ok {
+		return nil, m.write()
+	}
+	if truncate {
+		m.Tables[table] = &manifestTable{Comparator: mt.Comparator}
+	} else {
+		delete(m.Tables, table)
+	}
+	return mt.Segments, m.write()
+}
+
+// renameTable moves the segments of a table to a new name. the segment files are not renamed, instead the
+// segments record the old name as their base. seq is the log sequence number of the table record
+func (m *manifest) renameTable(from string, to string, seq uint64) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.TableSequence = seq
+	mt, ok := m.Tables[from]
+	if !ok {
+		return m.write()
+	}
+	for i := range mt.Segments {
+		if mt.Segments[i].Base == "" {
+			mt.Segments[i].Base = from
+		}
+		if mt.Segments[i].Base == to {
+			mt.Segments[i].Base = ""
+		}
+	}
+	delete(m.Tables, from)
+	m.Tables[to] = mt
+	return m.write()
+}
+
+// format returns the format of a segment of the table. segments written before the version and block size were
+// recorded are version 1 with the default block size, and no bloom filter
+func (ms manifestSegment) format(options Options, table string) segmentFormat {
+	format := options.segmentFormat(table)
+	format.version = ms.Version
+	if format.version == 0 {
+		format.version = segmentVersion1
+	}
+	format.keyBlockSize = ms.KeyBlockSize
+	if format.keyBlockSize == 0 {
+		format.keyBlockSize = defaultKeyBlockSize
+	}
+	format.bloomBitsPerKey = ms.BloomBitsPerKey
+	format.compressor = nil
+	if ms.Compression != "" {
+		format.compressor = options.compressorNamed(ms.Compression)
+	}
+	return format
+}
+
+// deletedRanges returns the range tombstones of the segment
+func (ms manifestSegment) deletedRanges() []keyRange {
+	var deleted []keyRange
+	for _, r := range ms.DeletedRanges {
+		deleted = append(deleted, keyRange{lower: nonEmpty(r.Lower), upper: nonEmpty(r.Upper)})
+	}
+	return deleted
+}
+
+// nonEmpty returns nil for an empty slice, since an empty bound is unbounded
+func nonEmpty(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+func segmentFilenames(dbpath string, table string, ms manifestSegment) (keyFilename, dataFilename string) {
+	base := ms.Base
+	if base == "" {
+		base = table
+	}
+	keyFilename = filepath.Join(dbpath, fmt.Sprint(base, ".keys.", ms.ID))
+	dataFilename = filepath.Join(dbpath, fmt.Sprint(base, ".data.", ms.ID))
+	return
+}
+
+// segmentBase returns the base name of a segment file, i.e. the name without the .keys.id or .data.id suffix
+func segmentBase(filename string) string {
+	name := filepath.Base(filename)
+	index := strings.LastIndex(name, ".keys.")
+	if index < 0 {
+		index = strings.LastIndex(name, ".data.")
+	}
+	if index < 0 {
+		return name
+	}
+	return name[:index]
+}
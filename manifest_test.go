@@ -0,0 +1,80 @@
+package keydb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	os.RemoveAll("test")
+
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	for _, key := range []string{"mykey", "mykey2", "mykey3"} {
+		tx, err := db.BeginTX("main")
+		if err != nil {
+			t.Fatal("unable to create transaction", err)
+		}
+		tx.Put([]byte(key), []byte("myvalue"))
+		err = tx.CommitSync()
+		if err != nil {
+			t.Fatal("unable to commit", err)
+		}
+	}
+	err = db.CloseWithMerge(0)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	m, err := readManifest("test/mydb")
+	if err != nil {
+		t.Fatal("unable to read manifest", err)
+	}
+	if len(m.segments("main")) != 3 || m.NextSegmentID != 3 {
+		t.Fatal("incorrect manifest", m.segments("main"), m.NextSegmentID)
+	}
+
+	// simulate a segment that was written but never recorded in the manifest
+	orphan := newMemorySegment()
+	orphan.Put([]byte("orphan"), []byte("myvalue"))
+	itr, _ := orphan.Lookup(nil, nil)
+	keyFilename, dataFilename := segmentFilenames("test/mydb", "main", manifestSegment{ID: 99})
+	ds, err := writeAndLoadSegment(keyFilename, dataFilename, itr, defaultSegmentFormat, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.Close()
+
+	db, err = Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	_, err = tx.Get([]byte("orphan"))
+	if err != KeyNotFound {
+		t.Fatal("segment not in manifest should be ignored", err)
+	}
+	tx.Put([]byte("mykey4"), []byte("myvalue"))
+	err = tx.CommitSync()
+	if err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	err = db.CloseWithMerge(0)
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	m, err = readManifest("test/mydb")
+	if err != nil {
+		t.Fatal("unable to read manifest", err)
+	}
+	segments := m.segments("main")
+	if len(segments) != 4 || segments[3].ID != 3 {
+		t.Fatal("segment ids should not be reused", segments)
+	}
+}
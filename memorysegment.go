@@ -7,12 +7,18 @@ package keydb
 //
 
 type memorySegment struct {
-	tree *Tree
+	tree    *Tree
+	deleted []keyRange
 }
 
 func newMemorySegment() segment {
+	return newMemorySegmentWithComparator(nil)
+}
+
+// newMemorySegmentWithComparator creates a memory segment for a table with the comparator, nil is bytewise
+func newMemorySegmentWithComparator(comparator Comparator) segment {
 	ms := new(memorySegment)
-	ms.tree = &Tree{}
+	ms.tree = &Tree{comparator: comparator}
 
 	return ms
 }
@@ -22,13 +28,40 @@ func (ms *memorySegment) Put(key []byte, value []byte) error {
 	return nil
 }
 func (ms *memorySegment) Get(key []byte) ([]byte, error) {
-	value, ok := ms.tree.Find(key)
-	if !ok {
+	n := ms.tree.root.find(ms.tree.comparator, key)
+	if n == nil {
 		return nil, KeyNotFound
 	}
-	return value, nil
+	if n.operand {
+		return n.data, errMergeOperand
+	}
+	return n.data, nil
 
 }
+
+// Merge a merge operand into the segment. if the segment has a value for the key, or removed it, the operand
+// is applied to the value, otherwise it is combined with any operand the segment has for the key
+func (ms *memorySegment) Merge(key []byte, operand []byte, operator MergeOperator) error {
+	n := ms.tree.root.find(ms.tree.comparator, key)
+	if n == nil {
+		if !rangesContain(ms.tree.comparator, ms.deleted, key) {
+			ms.tree.insertOperand(key, operand)
+			return nil
+		}
+		value, err := operator(key, nil, operand)
+		if err != nil {
+			return err
+		}
+		ms.tree.Insert(key, value)
+		return nil
+	}
+	value, err := operator(key, n.data, operand)
+	if err != nil {
+		return err
+	}
+	n.data = value
+	return nil
+}
 func (ms *memorySegment) Remove(key []byte) ([]byte, error) {
 	value, ok := ms.tree.Remove(key)
 	if ok {
@@ -37,32 +70,65 @@ func (ms *memorySegment) Remove(key []byte) ([]byte, error) {
 	return nil, KeyNotFound
 }
 
+func (ms *memorySegment) DeleteRange(lower []byte, upper []byte) error {
+	// the keys already in the segment are removed, since the range only applies to older segments
+	cursor := newTreeCursor(ms.tree, lower, upper, false)
+	for n := cursor.next(); n != nil; n = cursor.next() {
+		n.data = nil
+		n.operand = false
+	}
+	ms.deleted = append(ms.deleted, keyRange{lower: lower, upper: upper})
+	return nil
+}
+
+func (ms *memorySegment) deletedRanges() []keyRange {
+	return ms.deleted
+}
+
+// bounds returns an unbounded range, so that a memory segment is never skipped, since its keys change while it is
+// read and its iterators return the keys added after they are created
+func (ms *memorySegment) bounds() (keyRange, bool) {
+	return keyRange{}, true
+}
+
 func (ms *memorySegment) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
-	return &memorySegmentIterator{results: ms.tree.FindNodes(lower, upper), index: 0}, nil
+	return &memorySegmentIterator{cursor: newTreeCursor(ms.tree, lower, upper, false)}, nil
+}
+
+func (ms *memorySegment) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	return &memorySegmentIterator{cursor: newTreeCursor(ms.tree, lower, upper, true)}, nil
 }
 
 func (ms *memorySegment) Close() error {
 	return nil
 }
 
+// memorySegmentIterator reads the tree as it is iterated, so it sees changes made to the segment after it
+// was created
 type memorySegmentIterator struct {
-	results []TreeEntry
-	index   int
+	cursor *treeCursor
 }
 
 func (es *memorySegmentIterator) Next() (key []byte, value []byte, err error) {
-	if es.index >= len(es.results) {
-		return nil, nil, EndOfIterator
+	key, value, _, err = es.nextRecord()
+	return
+}
+func (es *memorySegmentIterator) nextRecord() (key []byte, value []byte, operand bool, err error) {
+	n := es.cursor.next()
+	if n == nil {
+		return nil, nil, false, EndOfIterator
 	}
-	key = es.results[es.index].Key
-	value = es.results[es.index].Value
-	es.index++
-	return key, value, nil
+	return n.key, n.data, n.operand, nil
 }
 func (es *memorySegmentIterator) peekKey() ([]byte, error) {
-	if es.index >= len(es.results) {
+	n := es.cursor.peek()
+	if n == nil {
 		return nil, EndOfIterator
 	}
-	key := es.results[es.index].Key
-	return key, nil
+	return n.key, nil
+}
+
+func (es *memorySegmentIterator) Seek(key []byte) error {
+	es.cursor.seek(key)
+	return nil
 }
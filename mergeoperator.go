@@ -0,0 +1,81 @@
+package keydb
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// a merge operand is stored in a segment in place of a value, and it is applied to the value of the key in the older
+// segments when the key is read. merging an operand into a memory segment that already has a value for the key
+// replaces the value with the result. when segments are merged, the operands of a key are combined into a single
+// operand, unless the merged segments include a value for the key, or the merge includes the oldest segment, in which
+// case the result is written as a value
+
+// MergeOperator combines a merge operand with the existing value of a key, returning the new value. existing is nil if
+// the key does not exist. since operands are combined with each other before the value they apply to is known, the
+// operator must be associative, and merging an operand into a nil value must return the operand
+type MergeOperator func(key []byte, existing []byte, operand []byte) ([]byte, error)
+
+// Int64AddOperator is a MergeOperator for values that are 8 byte little endian integers, the operand is added to the value
+func Int64AddOperator(key []byte, existing []byte, operand []byte) ([]byte, error) {
+	if len(operand) != 8 || (existing != nil && len(existing) != 8) {
+		return nil, InvalidOperand
+	}
+	var sum int64
+	if existing != nil {
+		sum = int64(binary.LittleEndian.Uint64(existing))
+	}
+	sum += int64(binary.LittleEndian.Uint64(operand))
+
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, uint64(sum))
+	return value, nil
+}
+
+// AppendOperator is a MergeOperator that appends the operand to the value
+func AppendOperator(key []byte, existing []byte, operand []byte) ([]byte, error) {
+	value := make([]byte, 0, len(existing)+len(operand))
+	value = append(value, existing...)
+	return append(value, operand...), nil
+}
+
+// errMergeOperand is returned by the Get of a segment when the key has a merge operand rather than a value, along
+// with the operand
+var errMergeOperand = errors.New("merge operand")
+
+// recordIterator is implemented by the segment iterators, which return merge operands as well as values
+type recordIterator interface {
+	nextRecord() (key []byte, value []byte, operand bool, err error)
+}
+
+// nextRecord returns the next key of the iterator, and whether its value is a merge operand
+func nextRecord(itr LookupIterator) (key []byte, value []byte, operand bool, err error) {
+	if ri, ok := itr.(recordIterator); ok {
+		return ri.nextRecord()
+	}
+	key, value, err = itr.Next()
+	return key, value, false, err
+}
+
+// applyOperands applies the operands, which are ordered newest first, to the value
+func applyOperands(operator MergeOperator, key []byte, value []byte, operands [][]byte) ([]byte, error) {
+	if operator == nil {
+		return nil, NoMergeOperator
+	}
+	var err error
+	for i := len(operands) - 1; i >= 0; i-- {
+		value, err = operator(key, value, operands[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return value, nil
+}
+
+// combineOperands combines the operands, which are ordered newest first, into a single operand
+func combineOperands(operator MergeOperator, key []byte, operands [][]byte) ([]byte, error) {
+	if len(operands) == 1 {
+		return operands[0], nil
+	}
+	return applyOperands(operator, key, operands[len(operands)-1], operands[:len(operands)-1])
+}
@@ -3,15 +3,9 @@ package keydb
 import (
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
-	"strconv"
-	"sync/atomic"
 	"time"
 )
 
-var maxSegments = 8
-
 // merge on disk segments for the database
 func mergeDiskSegments(db *Database) {
 	defer db.wg.Done()
@@ -31,7 +25,7 @@ func mergeDiskSegments(db *Database) {
 
 		db.Unlock()
 
-		err := mergeDiskSegments0(db, maxSegments)
+		err := mergeDiskSegments0(db, db.options.MaxSegments)
 		if err != nil {
 			db.Lock()
 			db.err = errors.New("unable to merge segments: " + err.Error())
@@ -40,7 +34,7 @@ func mergeDiskSegments(db *Database) {
 
 		db.wg.Done()
 
-		time.Sleep(1 * time.Second)
+		time.Sleep(db.options.MergeInterval)
 	}
 }
 
@@ -62,6 +56,8 @@ func mergeDiskSegments0(db *Database, segmentCount int) error {
 }
 
 func mergeTableSegments(db *Database, table *internalTable, segmentCount int) error {
+	table.mergeLock.Lock()
+	defer table.mergeLock.Unlock()
 
 	var index = 0
 
@@ -103,75 +99,92 @@ func mergeTableSegments(db *Database, table *internalTable, segmentCount int) er
 			continue
 		}
 
-		id := mergable[len(mergable)-1].id
+		id := db.nextSegmentID()
 		segments = segments[index : index+len(mergable)]
 
-		newseg, err := mergeDiskSegments1(db.path, table.name, id, segments)
-		if err != nil {
+		// removed keys can only be purged if there are no older segments that contain the key
+		purge := index == 0
+
+		newseg, err := mergeDiskSegments1(db.path, table.name, id, segments, db.options.segmentFormat(table.name), purge, db.options.MergeOperators[table.name])
+		if err != nil && err != errEmptySegment {
 			return err
 		}
 
+		// open transactions and snapshots hold references to the merged segments, so the segments
+		// can be replaced immediately
 		table.Lock()
-		for table.transactions > 0 {
-			table.Unlock()
-			time.Sleep(100 * time.Millisecond)
-			table.Lock()
-		}
 
 		segments = table.segments
 
 		for i, s := range mergable {
 			if s != segments[i+index] {
+				table.Unlock()
 				return errors.New(fmt.Sprint("unexpected segment change,", s, segments[i+index]))
 			}
 		}
 
-		for _, s := range mergable {
-			err0 := s.keyFile.Close()
-			err1 := s.dataFile.Close()
-			err2 := os.Remove(s.keyFile.Name())
-			err3 := os.Remove(s.dataFile.Name())
-
-			err := errn(err0, err1, err2, err3)
-			if err != nil {
-				return err
-			}
-		}
-
 		newsegments := make([]segment, 0)
 
 		newsegments = append(newsegments, segments[:index]...)
-		newsegments = append(newsegments, newseg)
+		if newseg != nil {
+			newsegments = append(newsegments, newseg)
+		}
 		newsegments = append(newsegments, segments[index+len(mergable):]...)
 
 		table.segments = newsegments
 
+		// the merged segments can only be removed once the manifest no longer references them
+		err = updateManifest(db, table)
+		if err != nil {
+			table.Unlock()
+			return err
+		}
+
+		// the merged segments are removed when the last reference to them is released
+		for _, s := range mergable {
+			s.obsolete = true
+			err = s.release()
+			if err != nil {
+				table.Unlock()
+				return err
+			}
+		}
+
 		index++
 		table.Unlock()
 		time.Sleep(100 * time.Millisecond)
 	}
 }
 
-var mergeSeq uint64
+// mergeDiskSegments1 merges the segments into a new segment. if purge is true the removed keys and the range
+// tombstones are not written, and merge operands are applied. if nothing remains the error is errEmptySegment,
+// and the segment is nil
+func mergeDiskSegments1(dbpath string, table string, id uint64, segments []segment, format segmentFormat, purge bool, operator MergeOperator) (segment, error) {
 
-func mergeDiskSegments1(dbpath string, table string, id uint64, segments []segment) (segment, error) {
-
-	base := filepath.Join(dbpath, table+".merged.")
-
-	sid := strconv.FormatUint(id, 10)
-
-	seq := atomic.AddUint64(&mergeSeq, 1)
-	sseq := strconv.FormatUint(seq, 10)
-
-	keyFilename := base + "." + sseq + ".keys." + sid
-	dataFilename := base + "." + sseq + ".data." + sid
+	keyFilename, dataFilename := segmentFilenames(dbpath, table, manifestSegment{ID: id})
 
 	ms := newMultiSegment(segments)
+	ms.operator = operator
+	ms.comparator = format.comparator
+	ms.partial = !purge
 	itr, err := ms.Lookup(nil, nil)
 	if err != nil {
 		return nil, err
 	}
+	// the range tombstones are kept unless they are purged along with the keys they removed
+	deleted := ms.deletedRanges()
+	if purge {
+		itr = &transactionLookup{itr}
+		deleted = nil
+	}
+
+	var sources []uint64
+	for _, s := range segments {
+		if ds, ok := s.(*diskSegment); ok {
+			sources = append(sources, ds.id)
+		}
+	}
 
-	return writeAndLoadSegment(keyFilename, dataFilename, itr)
+	return writeAndLoadSegment(keyFilename, dataFilename, itr, format, deleted, sources)
 
 }
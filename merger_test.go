@@ -18,7 +18,7 @@ func TestMerger(t *testing.T) {
 		m2.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
 	}
 
-	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m1, m2})
+	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m1, m2}, defaultSegmentFormat, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -51,7 +51,7 @@ func TestMergerRemove(t *testing.T) {
 		m2.Remove([]byte(fmt.Sprint("mykey", i)))
 	}
 
-	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m1, m2})
+	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m1, m2}, defaultSegmentFormat, false, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,3 +73,91 @@ func TestMergerRemove(t *testing.T) {
 		t.Fatal("wrong number of records", count)
 	}
 }
+
+func TestMergerPurge(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m1 := newMemorySegment()
+	for i := 0; i < 1000; i++ {
+		m1.Put([]byte(fmt.Sprint("mykey", i)), []byte(fmt.Sprint("myvalue", i)))
+	}
+	m2 := newMemorySegment()
+	for i := 0; i < 1000; i += 2 {
+		m2.Remove([]byte(fmt.Sprint("mykey", i)))
+	}
+
+	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m1, m2}, defaultSegmentFormat, true, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	itr, err := merged.Lookup(nil, nil)
+	count := 0
+
+	for {
+		_, v, err := itr.Next()
+		if err != nil {
+			break
+		}
+		if v == nil {
+			t.Fatal("removed key was not purged")
+		}
+		count++
+	}
+
+	if count != 500 {
+		t.Fatal("wrong number of records", count)
+	}
+
+	m3 := newMemorySegment()
+	for i := 0; i < 1000; i++ {
+		m3.Remove([]byte(fmt.Sprint("mykey", i)))
+	}
+
+	_, err = mergeDiskSegments1("test", "testtable", 1, []segment{merged, m3}, defaultSegmentFormat, true, nil)
+	if err != errEmptySegment {
+		t.Fatal("expected empty segment", err)
+	}
+}
+
+func TestMergerOperands(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+	m1 := newMemorySegment()
+	m1.Put([]byte("mykey1"), []byte("a"))
+	m2 := newMemorySegment()
+	m2.Merge([]byte("mykey1"), []byte("b"), AppendOperator)
+	m2.Merge([]byte("mykey2"), []byte("b"), AppendOperator)
+	m3 := newMemorySegment()
+	m3.Merge([]byte("mykey1"), []byte("c"), AppendOperator)
+	m3.Merge([]byte("mykey2"), []byte("c"), AppendOperator)
+
+	// the operands are combined, since the merge does not include the oldest segment
+	merged, err := mergeDiskSegments1("test", "testtable", 0, []segment{m2, m3}, defaultSegmentFormat, false, AppendOperator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := merged.Get([]byte("mykey1"))
+	if err != errMergeOperand || string(value) != "bc" {
+		t.Fatal("operands should be combined", string(value), err)
+	}
+
+	ms := newMultiSegment([]segment{m1, merged})
+	ms.operator = AppendOperator
+	value, err = ms.Get([]byte("mykey1"))
+	if err != nil || string(value) != "abc" {
+		t.Fatal("incorrect value", string(value), err)
+	}
+
+	merged, err = mergeDiskSegments1("test", "testtable", 1, []segment{m1, merged}, defaultSegmentFormat, true, AppendOperator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, _ := merged.Lookup(nil, nil)
+	for _, expected := range []string{"abc", "bc"} {
+		_, value, operand, err := nextRecord(itr)
+		if err != nil || operand || string(value) != expected {
+			t.Fatal("incorrect value", string(value), operand, err)
+		}
+	}
+}
@@ -1,76 +1,138 @@
 package keydb
 
 // multiSegment presents multiple segments as a single segment. The segments are ordered, since the different segments
-// may contain the same key with different values (due to an update or a remove)
+// may contain the same key with different values (due to an update or a remove). Get and Lookup skip the segments
+// that cannot hold the key, or any key in the range, so only their range tombstones are checked
 type multiSegment struct {
 	segments []segment
+	// the order of the keys, nil is bytewise
+	comparator Comparator
+	// nil if the table has no merge operator
+	operator MergeOperator
+	// the merge operands of a key are combined into an operand, rather than applied to a missing value, if no
+	// segment has a value for the key. used when merging segments that are not the oldest
+	partial bool
 }
 
 type multiSegmentIterator struct {
+	multi     *multiSegment
 	iterators []LookupIterator
+	// the keys are returned in descending order
+	reverse bool
 }
 
-func (msi *multiSegmentIterator) peekKey() ([]byte, error) {
-	panic("peekKey called on multiSegmentIterator")
-}
-
-func (msi *multiSegmentIterator) Next() (key []byte, value []byte, err error) {
-	var currentIndex = -1
-	var lowest []byte
-
-	// find the lowest next non-deleted key in any of the iterators
+// next returns the index of the iterator with the next key, or -1 if all of the iterators are exhausted. if several
+// iterators have the same key, the iterator for the newest segment is returned
+func (msi *multiSegmentIterator) next() (int, []byte, error) {
+	var current = -1
+	var next []byte
 
 	for i := len(msi.iterators) - 1; i >= 0; i-- {
-		iterator := msi.iterators[i]
-
-		var key []byte
-		var err error
-		for {
-			key, err = iterator.peekKey()
-			if err == nil && key == nil {
-				iterator.Next()
-			} else {
-				break
-			}
+		key, err := msi.iterators[i].peekKey()
+		if err == EndOfIterator {
+			continue
 		}
-
 		if err != nil {
-			continue
+			return -1, nil, err
 		}
-
-		if lowest == nil || less(key, lowest) {
-			lowest = make([]byte, len(key))
-			copy(lowest, key)
-			currentIndex = i
+		if current == -1 || msi.before(key, next) {
+			next = key
+			current = i
 		}
 	}
+	return current, next, nil
+}
 
-	if currentIndex == -1 {
-		return nil, nil, EndOfIterator
+func (msi *multiSegmentIterator) before(a, b []byte) bool {
+	if msi.reverse {
+		return less(msi.multi.comparator, b, a)
 	}
+	return less(msi.multi.comparator, a, b)
+}
 
-	key, value, err = msi.iterators[currentIndex].Next()
+func (msi *multiSegmentIterator) peekKey() ([]byte, error) {
+	current, key, err := msi.next()
+	if err != nil {
+		return nil, err
+	}
+	if current == -1 {
+		return nil, EndOfIterator
+	}
+	return key, nil
+}
 
-	// advance all of the iterators past the current
-	for i := len(msi.iterators) - 1; i >= 0; i-- {
-		if i == currentIndex {
-			continue
+func (msi *multiSegmentIterator) Next() (key []byte, value []byte, err error) {
+	key, value, _, err = msi.nextRecord()
+	return
+}
+
+// nextRecord returns the next key, applying any merge operands to its value. the value is only a merge operand if
+// the multiSegment is partial
+func (msi *multiSegmentIterator) nextRecord() (key []byte, value []byte, operand bool, err error) {
+	current, key, err := msi.next()
+	if err != nil {
+		return nil, nil, false, err
+	}
+	if current == -1 {
+		return nil, nil, false, EndOfIterator
+	}
+
+	segments := msi.multi.segments
+
+	// the key is removed if a newer segment deleted a range containing it
+	found := false
+	for _, s := range segments[current+1:] {
+		if rangesContain(msi.multi.comparator, s.deletedRanges(), key) {
+			found = true
+			break
 		}
+	}
+
+	var operands [][]byte
+
+	// read the key from the newest segment, and the older segments as long as it is a merge operand. the key
+	// is skipped in the remaining segments, as it was replaced or removed
+	for i := current; i >= 0; i-- {
 		iterator := msi.iterators[i]
-		for {
-			key, err := iterator.peekKey()
+		other, err := iterator.peekKey()
+		if err == nil && (i == current || equal(msi.multi.comparator, other, key)) {
+			_, v, isOperand, err := nextRecord(iterator)
 			if err != nil {
-				break
+				return nil, nil, false, err
 			}
-			if key == nil || !less(lowest, key) {
-				msi.Next()
-			} else {
-				break
+			if !found {
+				if isOperand {
+					operands = append(operands, v)
+				} else {
+					value = v
+					found = true
+				}
 			}
 		}
+		if !found && rangesContain(msi.multi.comparator, segments[i].deletedRanges(), key) {
+			found = true
+		}
 	}
 
-	return
+	if len(operands) == 0 {
+		return key, value, false, nil
+	}
+	if !found && msi.multi.partial {
+		value, err = combineOperands(msi.multi.operator, key, operands)
+		return key, value, true, err
+	}
+	value, err = applyOperands(msi.multi.operator, key, value, operands)
+	return key, value, false, err
+}
+
+func (msi *multiSegmentIterator) Seek(key []byte) error {
+	for _, iterator := range msi.iterators {
+		err := iterator.Seek(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func newMultiSegment(segments []segment) *multiSegment {
@@ -82,29 +144,112 @@ func (ms *multiSegment) Put(key []byte, value []byte) error {
 }
 
 func (ms *multiSegment) Get(key []byte) ([]byte, error) {
+	var operands [][]byte
+	var value []byte
+	found := false
+
 	// segments are in chronological order, so search in reverse
 	for i := len(ms.segments) - 1; i >= 0; i-- {
 		s := ms.segments[i]
-		val, err := s.Get(key)
-		if err == nil {
-			return val, nil
+		if r, ok := s.bounds(); ok && r.contains(ms.comparator, key) {
+			val, err := s.Get(key)
+			if err == nil {
+				value = val
+				found = true
+				break
+			}
+			if err == errMergeOperand {
+				operands = append(operands, val)
+			} else if err != KeyNotFound {
+				return nil, err
+			}
+		}
+		if rangesContain(ms.comparator, s.deletedRanges(), key) {
+			found = true
+			break
 		}
 	}
-	return nil, KeyNotFound
+	if len(operands) > 0 {
+		return applyOperands(ms.operator, key, value, operands)
+	}
+	if !found {
+		return nil, KeyNotFound
+	}
+	return value, nil
 }
 
 func (ms *multiSegment) Remove(key []byte) ([]byte, error) {
 	panic("Remove called on multiSegmentIterator")
 }
 
+func (ms *multiSegment) Merge(key []byte, operand []byte, operator MergeOperator) error {
+	panic("Merge called on multiSegmentIterator")
+}
+
+func (ms *multiSegment) DeleteRange(lower []byte, upper []byte) error {
+	panic("DeleteRange called on multiSegmentIterator")
+}
+
+// deletedRanges returns the range tombstones of all of the segments
+func (ms *multiSegment) deletedRanges() []keyRange {
+	var deleted []keyRange
+	for _, s := range ms.segments {
+		deleted = append(deleted, s.deletedRanges()...)
+	}
+	return deleted
+}
+
+// overlaps returns true if a segment may have keys in the range
+func (ms *multiSegment) overlaps(s segment, lower []byte, upper []byte) bool {
+	r, ok := s.bounds()
+	return ok && r.overlaps(ms.comparator, keyRange{lower: lower, upper: upper})
+}
+
+// a segment that cannot have keys in the range of a Lookup is given an empty iterator, rather than being removed, so
+// that the iterators stay in the order of the segments, whose range tombstones are still applied
 func (ms *multiSegment) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
 	iterators := make([]LookupIterator, 0)
 	for _, v := range ms.segments {
+		if !ms.overlaps(v, lower, upper) {
+			iterators = append(iterators, emptyIterator{})
+			continue
+		}
 		iterator, err := v.Lookup(lower, upper)
 		if err != nil {
 			return nil, err
 		}
 		iterators = append(iterators, iterator)
 	}
-	return &multiSegmentIterator{iterators: iterators}, nil
+	return &multiSegmentIterator{multi: ms, iterators: iterators}, nil
+}
+
+func (ms *multiSegment) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	iterators := make([]LookupIterator, 0)
+	for _, v := range ms.segments {
+		if !ms.overlaps(v, lower, upper) {
+			iterators = append(iterators, emptyIterator{})
+			continue
+		}
+		iterator, err := v.LookupReverse(lower, upper)
+		if err != nil {
+			return nil, err
+		}
+		iterators = append(iterators, iterator)
+	}
+	return &multiSegmentIterator{multi: ms, iterators: iterators, reverse: true}, nil
+}
+
+// emptyIterator is the iterator of a segment that has no keys in the range of a Lookup
+type emptyIterator struct{}
+
+func (emptyIterator) Next() (key []byte, value []byte, err error) {
+	return nil, nil, EndOfIterator
+}
+
+func (emptyIterator) Seek(key []byte) error {
+	return nil
+}
+
+func (emptyIterator) peekKey() ([]byte, error) {
+	return nil, EndOfIterator
 }
@@ -1,7 +1,9 @@
 package keydb
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"testing"
 )
 
@@ -62,3 +64,149 @@ func TestMultiSegment2(t *testing.T) {
 	}
 
 }
+
+func TestMultiSegmentReverse(t *testing.T) {
+	m1 := newMemorySegment()
+	for i := 0; i < 100; i++ {
+		m1.Put([]byte(fmt.Sprintf("mykey%03d", i)), []byte("old"))
+	}
+	m2 := newMemorySegment()
+	for i := 50; i < 150; i++ {
+		m2.Put([]byte(fmt.Sprintf("mykey%03d", i)), []byte("new"))
+	}
+	m2.Remove([]byte("mykey025"))
+
+	ms := newMultiSegment([]segment{m1, m2})
+	itr, err := ms.LookupReverse(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 149; i >= 0; i-- {
+		key, value, err := itr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(key) != fmt.Sprintf("mykey%03d", i) {
+			t.Fatal("incorrect key", string(key))
+		}
+		if i == 25 && value != nil {
+			t.Fatal("removed key should have a nil value")
+		}
+		if i >= 50 && string(value) != "new" || i < 50 && i != 25 && string(value) != "old" {
+			t.Fatal("incorrect value", string(key), string(value))
+		}
+	}
+	_, _, err = itr.Next()
+	if err != EndOfIterator {
+		t.Fatal("iterator should be exhausted", err)
+	}
+
+	err = itr.Seek([]byte("mykey060x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, value, _ := itr.Next()
+	if string(key) != "mykey060" || string(value) != "new" {
+		t.Fatal("incorrect key after seek", string(key), string(value))
+	}
+
+	itr, _ = ms.Lookup(nil, nil)
+	err = itr.Seek([]byte("mykey049x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, value, _ = itr.Next()
+	if string(key) != "mykey050" || string(value) != "new" {
+		t.Fatal("incorrect key after seek", string(key), string(value))
+	}
+}
+
+func TestMultiSegmentBounds(t *testing.T) {
+	os.RemoveAll("test")
+	os.Mkdir("test", os.ModePerm)
+
+	// each segment holds 100 keys, the oldest is written in the version 3 format which has no footer
+	var segments []segment
+	for i, version := range []int{segmentVersion3, segmentVersion4, segmentVersion4} {
+		m := newMemorySegment()
+		for j := i * 100; j < (i+1)*100; j++ {
+			m.Put([]byte(fmt.Sprintf("mykey%03d", j)), []byte(fmt.Sprint("myvalue", j)))
+		}
+		itr, _ := m.Lookup(nil, nil)
+		format := defaultSegmentFormat
+		format.version = version
+		ds, err := writeAndLoadSegment(fmt.Sprint("test/keyfile.", i), fmt.Sprint("test/datafile.", i), itr, format, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ds.Close()
+		r, ok := ds.bounds()
+		if !ok || string(r.lower) != fmt.Sprintf("mykey%03d", i*100) || string(r.upper) != fmt.Sprintf("mykey%03d", i*100+99) {
+			t.Fatal("incorrect bounds", version, string(r.lower), string(r.upper))
+		}
+		segments = append(segments, ds)
+	}
+	// the newest segment removes keys from the oldest segment
+	segments[2].(*diskSegment).deleted = []keyRange{{lower: []byte("mykey010"), upper: []byte("mykey019")}}
+
+	ms := newMultiSegment(segments)
+
+	value, err := ms.Get([]byte("mykey050"))
+	if err != nil || !bytes.Equal(value, []byte("myvalue50")) {
+		t.Fatal("incorrect value", err)
+	}
+	value, err = ms.Get([]byte("mykey015"))
+	if err != nil || value != nil {
+		t.Fatal("key should be removed by range tombstone", err)
+	}
+	_, err = ms.Get([]byte("mykey300"))
+	if err != KeyNotFound {
+		t.Fatal("key should not be found", err)
+	}
+
+	itr, err := ms.Lookup([]byte("mykey120"), []byte("mykey130"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterators := itr.(*multiSegmentIterator).iterators
+	if _, ok := iterators[0].(emptyIterator); !ok {
+		t.Fatal("segment outside of range should be skipped")
+	}
+	if _, ok := iterators[2].(emptyIterator); !ok {
+		t.Fatal("segment outside of range should be skipped")
+	}
+	if count := countValues(t, itr); count != 11 {
+		t.Fatal("incorrect count", count)
+	}
+
+	for _, reverse := range []bool{false, true} {
+		if reverse {
+			itr, err = ms.LookupReverse([]byte("mykey005"), []byte("mykey025"))
+		} else {
+			itr, err = ms.Lookup([]byte("mykey005"), []byte("mykey025"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count := countValues(t, itr); count != 11 {
+			t.Fatal("range tombstone of skipped segment should apply", reverse, count)
+		}
+	}
+}
+
+// countValues returns the number of keys that are not removed
+func countValues(t *testing.T, itr LookupIterator) int {
+	count := 0
+	for {
+		_, value, err := itr.Next()
+		if err == EndOfIterator {
+			return count
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != nil {
+			count++
+		}
+	}
+}
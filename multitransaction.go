@@ -0,0 +1,259 @@
+package keydb
+
+// MultiTransaction is a transaction spanning several database tables. the changes made to all of the tables are
+// committed atomically, they are recorded as a single write-ahead log record and a single manifest update
+type MultiTransaction struct {
+	db   *Database
+	open bool
+	// the transaction for each table
+	txs []*Transaction
+}
+
+// BeginMultiTX starts a transaction for several database tables. only the listed tables can be used by
+// the transaction. a MultiTransaction can only be used by a single Go routine, and it should be completed
+// with either Commit, or Rollback
+func (db *Database) BeginMultiTX(tables ...string) (*MultiTransaction, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.err != nil {
+		return nil, db.err
+	}
+
+	if db.closing {
+		return nil, DatabaseClosed
+	}
+
+	its := make([]*internalTable, 0)
+	for _, table := range tables {
+		it, err := db.getTable(table)
+		if err != nil {
+			return nil, err
+		}
+		if !containsTable(its, it) {
+			its = append(its, it)
+		}
+	}
+
+	for _, it := range its {
+		db.stallWrites(it)
+	}
+
+	// all of the tables are locked so that the transaction sees a consistent view across them
+	lockTables(its)
+	defer unlockTables(its)
+
+	mtx := &MultiTransaction{db: db, open: true}
+	for _, it := range its {
+		mtx.txs = append(mtx.txs, db.newTransaction(it, false))
+	}
+	return mtx, nil
+}
+
+func containsTable(tables []*internalTable, table *internalTable) bool {
+	for _, t := range tables {
+		if t == table {
+			return true
+		}
+	}
+	return false
+}
+
+// table returns the part of the transaction for a table, which must have been passed to BeginMultiTX
+func (mtx *MultiTransaction) table(table string) (*Transaction, error) {
+	if !mtx.open {
+		return nil, TransactionClosed
+	}
+	for _, tx := range mtx.txs {
+		if tx.table == table {
+			return tx, nil
+		}
+	}
+	return nil, TableNotInTransaction
+}
+
+// Get a value for a key in a table, error is non-nil if the key was not found or an error occurred
+func (mtx *MultiTransaction) Get(table string, key []byte) ([]byte, error) {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Get(key)
+}
+
+// Put a key/value pair into a table, overwriting any existing entry. empty keys are not supported.
+func (mtx *MultiTransaction) Put(table string, key []byte, value []byte) error {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return err
+	}
+	return tx.Put(key, value)
+}
+
+// Remove a key and its value from a table. empty keys are not supported.
+func (mtx *MultiTransaction) Remove(table string, key []byte) ([]byte, error) {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Remove(key)
+}
+
+// Delete a key and its value from a table, without reading it, see Transaction.Delete
+func (mtx *MultiTransaction) Delete(table string, key []byte) error {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return err
+	}
+	return tx.Delete(key)
+}
+
+// Merge a merge operand into the value for a key in a table, see Transaction.Merge
+func (mtx *MultiTransaction) Merge(table string, key []byte, operand []byte) error {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return err
+	}
+	return tx.Merge(key, operand)
+}
+
+// DeleteRange removes all of the keys in a table between lower and upper inclusive, see Transaction.DeleteRange
+func (mtx *MultiTransaction) DeleteRange(table string, lower []byte, upper []byte) error {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return err
+	}
+	return tx.DeleteRange(lower, upper)
+}
+
+// Lookup finds matching record in a table between lower and upper inclusive, see Transaction.Lookup
+func (mtx *MultiTransaction) Lookup(table string, lower []byte, upper []byte) (LookupIterator, error) {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	return tx.Lookup(lower, upper)
+}
+
+// LookupReverse finds matching records in a table in descending key order, see Transaction.LookupReverse
+func (mtx *MultiTransaction) LookupReverse(table string, lower []byte, upper []byte) (LookupIterator, error) {
+	tx, err := mtx.table(table)
+	if err != nil {
+		return nil, err
+	}
+	return tx.LookupReverse(lower, upper)
+}
+
+// Commit persists the changes to all of the tables. either all of the changes survive a process crash,
+// or none do. after Commit the transaction can no longer be used
+func (mtx *MultiTransaction) Commit() error {
+	tables, its, err := mtx.close()
+	if err != nil {
+		return err
+	}
+	db := mtx.db
+
+	lockTables(its)
+	defer unlockTables(its)
+
+	for _, it := range its {
+		it.transactions--
+	}
+
+	seq, err := db.log.append(tables, db.options.SyncCommits)
+	if err != nil {
+		return err
+	}
+
+	for i, it := range its {
+		it.segments = append(it.segments, tables[i].memory)
+		it.committed(tables[i].memory)
+	}
+
+	writeSegmentsToDiskAsync(db, seq, tables)
+
+	return nil
+}
+
+// CommitSync persists the changes to all of the tables, waiting for the disk segments to be written, see
+// Transaction.CommitSync. after Commit the transaction can no longer be used
+func (mtx *MultiTransaction) CommitSync() error {
+	tables, its, err := mtx.close()
+	if err != nil {
+		return err
+	}
+	db := mtx.db
+
+	db.Lock()
+	err = db.err
+	db.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	lockTables(its)
+
+	for _, it := range its {
+		it.transactions--
+	}
+
+	seq, err := db.log.append(tables, true)
+	if err != nil {
+		unlockTables(its)
+		return err
+	}
+
+	for i, it := range its {
+		it.segments = append(it.segments, tables[i].memory)
+		it.committed(tables[i].memory)
+	}
+
+	db.wg.Add(1)
+
+	unlockTables(its)
+
+	err = writeSegmentsToDisk(db, seq, tables)
+	db.wg.Done() // allows database to close with no writers pending
+
+	return err
+}
+
+// close ends the transaction, returning the memory segment of each table, and the tables in the same order
+func (mtx *MultiTransaction) close() ([]logTable, []*internalTable, error) {
+	db := mtx.db
+	db.Lock()
+	defer db.Unlock()
+
+	if !mtx.open {
+		return nil, nil, TransactionClosed
+	}
+	mtx.open = false
+
+	var tables []logTable
+	var its []*internalTable
+	for _, tx := range mtx.txs {
+		delete(db.transactions, tx.id)
+		tx.open = false
+		releaseSegments(tx.multi.segments)
+		tables = append(tables, logTable{table: tx.table, memory: tx.memory})
+		its = append(its, db.tables[tx.table])
+	}
+	return tables, its, nil
+}
+
+// Rollback discards the changes to all of the tables. after Rollback the transaction can no longer be used
+func (mtx *MultiTransaction) Rollback() error {
+	_, its, err := mtx.close()
+	if err != nil {
+		return err
+	}
+
+	lockTables(its)
+	defer unlockTables(its)
+
+	for _, it := range its {
+		it.transactions--
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package keydb
+
+import (
+	"fmt"
+	"time"
+)
+
+// Options controls the behavior of a database opened with OpenWithOptions. a zero value for any setting
+// selects the default.
+type Options struct {
+	// CreateIfNeeded creates the database if it does not exist
+	CreateIfNeeded bool
+	// MaxSegments is the number of segments per table that the background merger, and Close, reduce a table to
+	MaxSegments int
+	// MergeInterval is the delay between runs of the background merger
+	MergeInterval time.Duration
+	// WriteStallSegments is the number of segments in a table at which BeginTX waits for the merger to catch up
+	WriteStallSegments int
+	// KeyBlockSize is the size of the key blocks in newly written segments. it must be between 2048 and 65536.
+	// the block size is recorded for every segment, so existing segments remain readable if it is changed
+	KeyBlockSize int
+	// KeyIndexInterval is the number of key blocks between entries in the in-memory key index of a segment
+	KeyIndexInterval int
+	// SyncCommits syncs the write-ahead log on every Commit, rather than only on CommitSync
+	SyncCommits bool
+	// BloomBitsPerKey is the size of the bloom filter written with each segment, which allows Get to skip segments
+	// that do not contain the key. a negative value disables the filters. 10 bits per key gives a false positive
+	// rate of about 1%
+	BloomBitsPerKey int
+	// MergeOperators holds the MergeOperator for each table that supports Merge, by table name
+	MergeOperators map[string]MergeOperator
+	// Comparators holds the Comparator for each table that does not use BytewiseComparator, by table name
+	Comparators map[string]Comparator
+	// BlockCacheSize is the size in bytes of the cache of decoded key blocks, which is shared by all of the tables.
+	// a negative value disables the cache
+	BlockCacheSize int64
+	// Compressors holds the Compressor for each table whose new segments are compressed, by table name. existing
+	// segments are read with the compressor they were written with, which must be FlateCompressor or listed here
+	Compressors map[string]Compressor
+
+	// the block cache of the database, created when it is opened
+	cache *blockCache
+}
+
+const defaultMaxSegments = 8
+const defaultMergeInterval = 1 * time.Second
+const defaultKeyBlockSize = 4096
+const defaultKeyIndexInterval = 16
+const defaultBloomBitsPerKey = 10
+const defaultBlockCacheSize = 8 * 1024 * 1024
+
+const minKeyBlockSize = 2048
+const maxKeyBlockSize = 65536
+const maxBloomBitsPerKey = 64
+
+// withDefaults returns a copy of the options with any zero value replaced by the default
+func (o Options) withDefaults() Options {
+	if o.MaxSegments == 0 {
+		o.MaxSegments = defaultMaxSegments
+	}
+	if o.MergeInterval == 0 {
+		o.MergeInterval = defaultMergeInterval
+	}
+	if o.WriteStallSegments == 0 {
+		o.WriteStallSegments = o.MaxSegments * 10
+	}
+	if o.KeyBlockSize == 0 {
+		o.KeyBlockSize = defaultKeyBlockSize
+	}
+	if o.KeyIndexInterval == 0 {
+		o.KeyIndexInterval = defaultKeyIndexInterval
+	}
+	if o.BloomBitsPerKey == 0 {
+		o.BloomBitsPerKey = defaultBloomBitsPerKey
+	}
+	if o.BlockCacheSize == 0 {
+		o.BlockCacheSize = defaultBlockCacheSize
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	if o.MaxSegments < 1 {
+		return fmt.Errorf("%w, MaxSegments must be positive", InvalidOptions)
+	}
+	if o.MergeInterval < 0 {
+		return fmt.Errorf("%w, MergeInterval must be positive", InvalidOptions)
+	}
+	if o.WriteStallSegments <= o.MaxSegments {
+		return fmt.Errorf("%w, WriteStallSegments must be greater than MaxSegments", InvalidOptions)
+	}
+	if o.KeyBlockSize < minKeyBlockSize || o.KeyBlockSize > maxKeyBlockSize {
+		return fmt.Errorf("%w, KeyBlockSize must be between %d and %d", InvalidOptions, minKeyBlockSize, maxKeyBlockSize)
+	}
+	if o.KeyIndexInterval < 1 {
+		return fmt.Errorf("%w, KeyIndexInterval must be positive", InvalidOptions)
+	}
+	if o.BloomBitsPerKey > maxBloomBitsPerKey {
+		return fmt.Errorf("%w, BloomBitsPerKey must be at most %d", InvalidOptions, maxBloomBitsPerKey)
+	}
+	for table, c := range o.Compressors {
+		if c != nil && (len(c.Name()) == 0 || len(c.Name()) > maxCompressorName) {
+			return fmt.Errorf("%w, the compressor name for table %s must be 1 to %d bytes", InvalidOptions, table, maxCompressorName)
+		}
+	}
+	return nil
+}
+
+// segment format versions. version 1 segments have no checksums, version 2 segments have a crc32c checksum at
+// the end of every key block, and following every value in the data file. version 3 segments use key records with
+// a record type and varint lengths, so keys and values are not limited by the record format. version 4 segments
+// have a header and footer in the key file, see segmentfooter.go
+const (
+	segmentVersion1 = 1
+	segmentVersion2 = 2
+	segmentVersion3 = 3
+	segmentVersion4 = 4
+)
+
+const currentSegmentVersion = segmentVersion4
+
+// segmentFormat holds the settings a segment is written with, which are needed to read it
+type segmentFormat struct {
+	version          int
+	keyBlockSize     int
+	keyIndexInterval int
+	// zero if the segment has no bloom filter
+	bloomBitsPerKey int
+	// the comparator of the table, nil is bytewise
+	comparator Comparator
+	// nil if the blocks are not compressed
+	compressor Compressor
+	// the block cache of the database, nil if there is no cache. it is not part of the format
+	cache *blockCache
+}
+
+var defaultSegmentFormat = segmentFormat{version: currentSegmentVersion, keyBlockSize: defaultKeyBlockSize, keyIndexInterval: defaultKeyIndexInterval, bloomBitsPerKey: defaultBloomBitsPerKey}
+
+// segmentFormat returns the format for new segments of a table
+func (o Options) segmentFormat(table string) segmentFormat {
+	format := segmentFormat{version: currentSegmentVersion, keyBlockSize: o.KeyBlockSize, keyIndexInterval: o.KeyIndexInterval}
+	if o.BloomBitsPerKey > 0 {
+		format.bloomBitsPerKey = o.BloomBitsPerKey
+	}
+	format.comparator = o.comparator(table)
+	format.compressor = o.Compressors[table]
+	format.cache = o.cache
+	return format
+}
+
+// comparator returns the comparator for a table
+func (o Options) comparator(table string) Comparator {
+	if c, ok := o.Comparators[table]; ok && c != nil {
+		return c
+	}
+	return BytewiseComparator
+}
+
+func (f segmentFormat) checksums() bool {
+	return f.version >= segmentVersion2
+}
+
+// fixedBlocks returns true if the key file is only a run of fixed size key blocks
+func (f segmentFormat) fixedBlocks() bool {
+	return f.version < segmentVersion4 && f.compressor == nil
+}
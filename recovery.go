@@ -0,0 +1,112 @@
+package keydb
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// files left behind by a process that terminated while writing or merging segments are cleaned up when the database
+// is opened. partially written files (.tmp) are removed. segment files that are not listed in the manifest are either
+// the inputs of a completed merge, or a segment whose commit is replayed from the log, so they are not needed, but they
+// are moved to the quarantine directory rather than removed, in case they were placed in the directory by hand.
+
+const quarantineDir = "quarantine"
+
+var segmentFileRegexp = regexp.MustCompile(".*\\.(keys|data)\\..*")
+
+func recoverFiles(dbpath string, m *manifest, options Options) error {
+	live := make(map[string]bool)
+	for table, mt := range m.Tables {
+		for _, ms := range mt.Segments {
+			keyFilename, dataFilename := segmentFilenames(dbpath, table, ms)
+			live[filepath.Base(keyFilename)] = true
+			live[filepath.Base(dataFilename)] = true
+		}
+	}
+
+	files, err := ioutil.ReadDir(dbpath)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, ".tmp") {
+			err = os.Remove(filepath.Join(dbpath, name))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if !segmentFileRegexp.MatchString(name) || live[name] {
+			continue
+		}
+		err = os.MkdirAll(filepath.Join(dbpath, quarantineDir), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(filepath.Join(dbpath, name), filepath.Join(dbpath, quarantineDir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	for table, mt := range m.Tables {
+		for _, ms := range mt.Segments {
+			keyFilename, dataFilename := segmentFilenames(dbpath, table, ms)
+			err = checkSegmentFiles(keyFilename, dataFilename, ms.format(options, table))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkSegmentFiles verifies that both files of a segment exist, and that the key file is a whole number of blocks,
+// or for version 4 segments that it starts with the header and ends with the footer
+func checkSegmentFiles(keyFilename, dataFilename string, format segmentFormat) error {
+	for _, filename := range []string{keyFilename, dataFilename} {
+		fi, err := os.Stat(filename)
+		if os.IsNotExist(err) {
+			return &SegmentError{Filename: filename, Err: SegmentMissing}
+		}
+		if err != nil {
+			return &SegmentError{Filename: filename, Err: err}
+		}
+		if filename == keyFilename && (fi.Size() == 0 || (format.fixedBlocks() && fi.Size()%int64(format.keyBlockSize) != 0)) {
+			return &SegmentError{Filename: filename, Err: SegmentCorrupted}
+		}
+		if filename == keyFilename && format.version >= segmentVersion4 && !hasSegmentMagic(filename, fi.Size()) {
+			return &SegmentError{Filename: filename, Err: SegmentCorrupted}
+		}
+	}
+	return nil
+}
+
+// hasSegmentMagic returns true if the key file starts and ends with the segment magic
+func hasSegmentMagic(filename string, size int64) bool {
+	if size < segmentHeaderSize+segmentTrailerSize {
+		return false
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(segmentMagic))
+	for _, offset := range []int64{0, size - int64(len(magic))} {
+		_, err = f.ReadAt(magic, offset)
+		if err != nil || !bytes.Equal(magic, segmentMagic) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,76 @@
+package keydb
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecovery(t *testing.T) {
+	os.RemoveAll("test")
+
+	db, err := Open("test/mydb", true)
+	if err != nil {
+		t.Fatal("unable to create database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	tx.Put([]byte("mykey"), []byte("myvalue"))
+	err = tx.CommitSync()
+	if err != nil {
+		t.Fatal("unable to commit", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// simulate an interrupted segment write, and an interrupted merge
+	ioutil.WriteFile("test/mydb/main.keys.5.tmp", []byte("partial"), os.ModePerm)
+	ioutil.WriteFile("test/mydb/main.keys.7", make([]byte, defaultKeyBlockSize), os.ModePerm)
+	ioutil.WriteFile("test/mydb/main.data.7", nil, os.ModePerm)
+
+	db, err = Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	_, err = tx.Get([]byte("mykey"))
+	if err != nil {
+		t.Fatal("unable to get by key", err)
+	}
+	tx.Commit()
+	db.Close()
+
+	if _, err := os.Stat("test/mydb/main.keys.5.tmp"); !os.IsNotExist(err) {
+		t.Fatal("tmp file should be removed")
+	}
+	if _, err := os.Stat(filepath.Join("test/mydb", quarantineDir, "main.keys.7")); err != nil {
+		t.Fatal("orphaned segment should be quarantined", err)
+	}
+
+	// a damaged segment is reported by Open
+	m, _ := readManifest("test/mydb")
+	keyFilename, _ := segmentFilenames("test/mydb", "main", m.segments("main")[0])
+	os.Truncate(keyFilename, 100)
+
+	_, err = Open("test/mydb", false)
+	var se *SegmentError
+	if !errors.As(err, &se) || se.Err != SegmentCorrupted || se.Filename != keyFilename {
+		t.Fatal("open should fail with a corrupted segment", err)
+	}
+
+	os.Remove(keyFilename)
+
+	_, err = Open("test/mydb", false)
+	if !errors.Is(err, SegmentMissing) {
+		t.Fatal("open should fail with a missing segment", err)
+	}
+}
@@ -6,6 +6,17 @@ type segment interface {
 	Put(key []byte, value []byte) error
 	Get(key []byte) ([]byte, error)
 	Remove(key []byte) ([]byte, error)
+	// Merge a merge operand for a key into the segment, see mergeoperator.go
+	Merge(key []byte, operand []byte, operator MergeOperator) error
+	// DeleteRange removes the keys between lower and upper inclusive, see deleterange.go
+	DeleteRange(lower []byte, upper []byte) error
+	// deletedRanges returns the range tombstones of the segment, which remove keys from the older segments
+	deletedRanges() []keyRange
+	// bounds returns the range of the keys in the segment, including removed keys, or false if the segment has no
+	// keys. the range tombstones of the segment are not included
+	bounds() (keyRange, bool)
 	Lookup(lower []byte, upper []byte) (LookupIterator, error)
+	// LookupReverse is Lookup, returning the keys in descending order
+	LookupReverse(lower []byte, upper []byte) (LookupIterator, error)
 	Close() error
 }
@@ -0,0 +1,249 @@
+package keydb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// the key file of a version 4 segment starts with a header
+//
+// magic [8]byte
+// version uint32
+// keyblocksize uint32
+// compressorlen uint8
+// compressor []byte (the name of the Compressor, empty if the segment is not compressed)
+//
+// the header has the settings needed to read the segment, so its format can be recovered without the manifest.
+//
+// and ends with a footer, which holds the metadata of the segment, so that it can be opened without reading its key
+// blocks. the key blocks, and the block index of a compressed segment, are between the header and the footer
+//
+// keyblocks uvarint
+// keyindexinterval uvarint
+// keyindex, the number of keys uvarint, then each key as keylen uvarint and key []byte
+// firstkey, keylen uvarint and key []byte (empty if the segment has no keys)
+// lastkey, keylen uvarint and key []byte
+// entries uvarint (the number of keys, including removed keys)
+// tombstones uvarint (the number of removed keys)
+// created varint (unix time in nanoseconds)
+// sources, the number of source segments uvarint, then each id uvarint (the segments merged to create the segment)
+// footerlen uint32
+// checksum uint32 (crc32c of the footer)
+// magic [8]byte
+
+var segmentMagic = []byte("keydbseg")
+
+// the size of the header without the compressor name
+const segmentHeaderSize = 17
+const segmentTrailerSize = 16
+
+// maxCompressorName is the length of the longest compressor name
+const maxCompressorName = 255
+
+// segmentHeader holds the settings in the header of a segment
+type segmentHeader struct {
+	version      int
+	keyBlockSize int
+	compressor   string
+}
+
+// segmentFooter is the metadata of a segment
+type segmentFooter struct {
+	keyBlocks        int64
+	keyIndexInterval int
+	keyIndex         [][]byte
+	firstKey         []byte
+	lastKey          []byte
+	entries          uint64
+	tombstones       uint64
+	created          time.Time
+	sources          []uint64
+}
+
+func encodeSegmentHeader(format segmentFormat) []byte {
+	var compressor string
+	if format.compressor != nil {
+		compressor = format.compressor.Name()
+	}
+	header := make([]byte, 0, segmentHeaderSize+len(compressor))
+	header = append(header, segmentMagic...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(format.version))
+	header = binary.LittleEndian.AppendUint32(header, uint32(format.keyBlockSize))
+	header = append(header, byte(len(compressor)))
+	return append(header, compressor...)
+}
+
+// decodeSegmentHeader reads the header of a key file of the length, returning it along with its length
+func decodeSegmentHeader(r io.ReaderAt, length int64) (segmentHeader, int64, bool) {
+	var header [segmentHeaderSize]byte
+	if length < segmentHeaderSize {
+		return segmentHeader{}, 0, false
+	}
+	_, err := r.ReadAt(header[:], 0)
+	if err != nil || !bytes.Equal(header[:8], segmentMagic) {
+		return segmentHeader{}, 0, false
+	}
+	headerlen := segmentHeaderSize + int64(header[16])
+	if headerlen > length {
+		return segmentHeader{}, 0, false
+	}
+	compressor := make([]byte, header[16])
+	_, err = r.ReadAt(compressor, segmentHeaderSize)
+	if err != nil {
+		return segmentHeader{}, 0, false
+	}
+	h := segmentHeader{
+		version:      int(binary.LittleEndian.Uint32(header[8:])),
+		keyBlockSize: int(binary.LittleEndian.Uint32(header[12:])),
+		compressor:   string(compressor),
+	}
+	return h, headerlen, true
+}
+
+// readSegmentHeader reads the header of a key file, returning false if the file does not have a header
+func readSegmentHeader(filename string) (segmentHeader, bool) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return segmentHeader{}, false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return segmentHeader{}, false
+	}
+	header, _, ok := decodeSegmentHeader(f, fi.Size())
+	return header, ok
+}
+
+// encodeSegmentFooter returns the footer along with its length, checksum and magic
+func encodeSegmentFooter(f segmentFooter) []byte {
+	appendKey := func(buf []byte, key []byte) []byte {
+		buf = binary.AppendUvarint(buf, uint64(len(key)))
+		return append(buf, key...)
+	}
+
+	var footer []byte
+	footer = binary.AppendUvarint(footer, uint64(f.keyBlocks))
+	footer = binary.AppendUvarint(footer, uint64(f.keyIndexInterval))
+	footer = binary.AppendUvarint(footer, uint64(len(f.keyIndex)))
+	for _, key := range f.keyIndex {
+		footer = appendKey(footer, key)
+	}
+	footer = appendKey(footer, f.firstKey)
+	footer = appendKey(footer, f.lastKey)
+	footer = binary.AppendUvarint(footer, f.entries)
+	footer = binary.AppendUvarint(footer, f.tombstones)
+	footer = binary.AppendVarint(footer, f.created.UnixNano())
+	footer = binary.AppendUvarint(footer, uint64(len(f.sources)))
+	for _, id := range f.sources {
+		footer = binary.AppendUvarint(footer, id)
+	}
+
+	checksum := crc32.Checksum(footer, crcTable)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(footer)))
+	footer = binary.LittleEndian.AppendUint32(footer, checksum)
+	return append(footer, segmentMagic...)
+}
+
+// loadSegmentFooter verifies the header of the key file of a version 4 segment, which sets the offset of the key
+// blocks, and reads its footer. it returns the offset of the footer, which is the end of the key blocks
+func loadSegmentFooter(ds *diskSegment) (segmentFooter, int64, error) {
+	corrupted := &SegmentError{Filename: ds.keyFile.Name(), Err: SegmentCorrupted}
+
+	var compressor string
+	if ds.format.compressor != nil {
+		compressor = ds.format.compressor.Name()
+	}
+	length := ds.keyFile.Length()
+	header, headerlen, ok := decodeSegmentHeader(ds.keyFile, length)
+	if !ok || header.version != ds.format.version || header.keyBlockSize != ds.format.keyBlockSize ||
+		header.compressor != compressor || length < headerlen+segmentTrailerSize {
+		return segmentFooter{}, 0, corrupted
+	}
+	ds.blocksOffset = headerlen
+
+	var trailer [segmentTrailerSize]byte
+	_, err := ds.keyFile.ReadAt(trailer[:], length-segmentTrailerSize)
+	if err != nil {
+		return segmentFooter{}, 0, err
+	}
+	footerlen := int64(binary.LittleEndian.Uint32(trailer[:]))
+	if !bytes.Equal(trailer[8:], segmentMagic) || footerlen > length-headerlen-segmentTrailerSize {
+		return segmentFooter{}, 0, corrupted
+	}
+	offset := length - segmentTrailerSize - footerlen
+	footer := make([]byte, footerlen)
+	_, err = ds.keyFile.ReadAt(footer, offset)
+	if err != nil {
+		return segmentFooter{}, 0, err
+	}
+	if crc32.Checksum(footer, crcTable) != binary.LittleEndian.Uint32(trailer[4:]) {
+		return segmentFooter{}, 0, &ErrCorruption{Filename: ds.keyFile.Name(), Offset: offset}
+	}
+
+	f, ok := decodeSegmentFooter(footer)
+	if !ok {
+		return segmentFooter{}, 0, corrupted
+	}
+	return f, offset, nil
+}
+
+func decodeSegmentFooter(footer []byte) (segmentFooter, bool) {
+	ok := true
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(footer)
+		if n <= 0 {
+			ok = false
+			return 0
+		}
+		footer = footer[n:]
+		return v
+	}
+	key := func() []byte {
+		keylen := uvarint()
+		if !ok || keylen > uint64(len(footer)) {
+			ok = false
+			return nil
+		}
+		if keylen == 0 {
+			return nil
+		}
+		key := make([]byte, keylen)
+		copy(key, footer)
+		footer = footer[keylen:]
+		return key
+	}
+
+	var f segmentFooter
+	f.keyBlocks = int64(uvarint())
+	f.keyIndexInterval = int(uvarint())
+	count := uvarint()
+	for i := uint64(0); ok && i < count; i++ {
+		f.keyIndex = append(f.keyIndex, key())
+	}
+	f.firstKey = key()
+	f.lastKey = key()
+	f.entries = uvarint()
+	f.tombstones = uvarint()
+	created, n := binary.Varint(footer)
+	if n <= 0 {
+		return f, false
+	}
+	footer = footer[n:]
+	f.created = time.Unix(0, created)
+	count = uvarint()
+	for i := uint64(0); ok && i < count; i++ {
+		f.sources = append(f.sources, uvarint())
+	}
+	if f.keyBlocks == 0 || f.keyIndexInterval <= 0 {
+		return f, false
+	}
+	if f.keyIndex == nil {
+		f.keyIndex = [][]byte{}
+	}
+	return f, ok && len(footer) == 0
+}
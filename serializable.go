@@ -0,0 +1,130 @@
+package keydb
+
+// a serializable transaction records the keys it reads, and the key ranges it scans. when it commits, the segments
+// committed to the table since it began are checked, and if any of them changed a key the transaction read or
+// wrote, the commit fails with ErrConflict. the table keeps the memory segments of recent commits for as long as
+// a serializable transaction that began before them is open.
+
+// recentCommit is a memory segment committed to a table while serializable transactions were open
+type recentCommit struct {
+	seq    uint64
+	memory segment
+}
+
+// BeginSerializableTX starts a transaction for a database table that fails to commit, with ErrConflict,
+// if another transaction committed a change to a key it read or wrote after it began. see BeginTX
+func (db *Database) BeginSerializableTX(table string) (*Transaction, error) {
+	return db.beginTX(table, true)
+}
+
+// beginSerializable registers a serializable transaction with the table. the caller must hold the table lock
+func (table *internalTable) beginSerializable(tx *Transaction) {
+	tx.serializable = true
+	tx.startSeq = table.commitSeq
+	tx.reads = make(map[string]bool)
+
+	if table.serializable == nil {
+		table.serializable = make(map[uint64]uint64)
+	}
+	table.serializable[tx.id] = tx.startSeq
+}
+
+// readKey records a key read by a serializable transaction
+func (tx *Transaction) readKey(key []byte) {
+	if tx.serializable {
+		tx.reads[string(key)] = true
+	}
+}
+
+// readRange records a range scanned by a serializable transaction
+func (tx *Transaction) readRange(lower, upper []byte) {
+	if tx.serializable {
+		tx.ranges = append(tx.ranges, keyRange{lower: append([]byte(nil), lower...), upper: append([]byte(nil), upper...)})
+	}
+}
+
+// checkConflicts returns ErrConflict if a segment committed after the transaction began contains a key, or deletes a
+// range, that the transaction read or wrote. the caller must hold the table lock
+func (table *internalTable) checkConflicts(tx *Transaction) error {
+	if !tx.serializable {
+		return nil
+	}
+	c := tx.multi.comparator
+	for _, rc := range table.recent {
+		if rc.seq <= tx.startSeq {
+			continue
+		}
+		itr, err := rc.memory.Lookup(nil, nil)
+		if err != nil {
+			return err
+		}
+		for {
+			key, _, err := itr.Next()
+			if err == EndOfIterator {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if tx.reads[string(key)] {
+				return ErrConflict
+			}
+			if _, err := tx.memory.Get(key); err == nil || err == errMergeOperand {
+				return ErrConflict
+			}
+			if rangesContain(c, tx.ranges, key) || rangesContain(c, tx.memory.deletedRanges(), key) {
+				return ErrConflict
+			}
+		}
+		for _, deleted := range rc.memory.deletedRanges() {
+			if rangesOverlap(c, tx.ranges, deleted) || rangesOverlap(c, tx.memory.deletedRanges(), deleted) {
+				return ErrConflict
+			}
+			for key := range tx.reads {
+				if deleted.contains(c, []byte(key)) {
+					return ErrConflict
+				}
+			}
+			itr, err := tx.memory.Lookup(deleted.lower, deleted.upper)
+			if err != nil {
+				return err
+			}
+			if _, _, err := itr.Next(); err == nil {
+				return ErrConflict
+			}
+		}
+	}
+	return nil
+}
+
+// committed records a memory segment committed to the table, if serializable transactions that may conflict
+// with it are open. the caller must hold the table lock
+func (table *internalTable) committed(memory segment) {
+	table.commitSeq++
+	if len(table.serializable) > 0 {
+		table.recent = append(table.recent, recentCommit{seq: table.commitSeq, memory: memory})
+	}
+}
+
+// endTransaction removes a completed serializable transaction, discarding the recent commits that no open
+// serializable transaction needs. the caller must hold the table lock
+func (table *internalTable) endTransaction(tx *Transaction) {
+	if !tx.serializable {
+		return
+	}
+	delete(table.serializable, tx.id)
+
+	oldest := table.commitSeq
+	for _, seq := range table.serializable {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+	recent := table.recent[:0]
+	for _, rc := range table.recent {
+		if rc.seq > oldest {
+			recent = append(recent, rc)
+		}
+	}
+	table.recent = recent
+}
@@ -0,0 +1,106 @@
+package keydb
+
+// Snapshot is a read-only, point-in-time view of a database table. it sees the commits made before it
+// was created, and none made after. the segments it uses are kept until it is closed, even if they are
+// replaced by a merge.
+type Snapshot struct {
+	open  bool
+	db    *Database
+	multi *multiSegment
+}
+
+// BeginReadTX creates a Snapshot of a database table. a Snapshot can only be used by a single Go routine,
+// and it should be completed with Close. the database cannot be closed while a Snapshot is open
+func (db *Database) BeginReadTX(table string) (*Snapshot, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.err != nil {
+		return nil, db.err
+	}
+
+	if db.closing {
+		return nil, DatabaseClosed
+	}
+
+	it, err := db.getTable(table)
+	if err != nil {
+		return nil, err
+	}
+
+	it.Lock()
+	defer it.Unlock()
+
+	db.snapshots++
+
+	segments := make([]segment, len(it.segments))
+	copy(segments, it.segments)
+	acquireSegments(segments)
+
+	multi := newMultiSegment(segments)
+	multi.operator = db.options.MergeOperators[table]
+	multi.comparator = db.options.comparator(table)
+
+	return &Snapshot{open: true, db: db, multi: multi}, nil
+}
+
+// Get a value for a key, error is non-nil if the key was not found or an error occurred
+func (s *Snapshot) Get(key []byte) (value []byte, err error) {
+	if !s.open {
+		return nil, TransactionClosed
+	}
+	if len(key) > MaxKeyLength {
+		return nil, KeyTooLong
+	}
+	value, err = s.multi.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil {
+		return nil, KeyNotFound
+	}
+	return
+}
+
+// Lookup finds matching record between lower and upper inclusive. lower or upper can be nil and
+// and then the range is unbounded on that side. Using the iterator after the snapshot has
+// been closed is not supported.
+func (s *Snapshot) Lookup(lower []byte, upper []byte) (LookupIterator, error) {
+	if !s.open {
+		return nil, TransactionClosed
+	}
+	itr, err := s.multi.Lookup(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	return &transactionLookup{itr}, nil
+}
+
+// LookupReverse finds matching records between lower and upper inclusive, like Lookup, but the
+// iterator returns them in descending key order
+func (s *Snapshot) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	if !s.open {
+		return nil, TransactionClosed
+	}
+	itr, err := s.multi.LookupReverse(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	return &transactionLookup{itr}, nil
+}
+
+// Close releases the segments used by the snapshot. after Close the snapshot can no longer be used
+func (s *Snapshot) Close() error {
+	s.db.Lock()
+	defer s.db.Unlock()
+
+	if !s.open {
+		return TransactionClosed
+	}
+	s.open = false
+	s.db.snapshots--
+
+	err := releaseSegments(s.multi.segments)
+	s.multi = nil
+	return err
+}
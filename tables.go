@@ -0,0 +1,231 @@
+package keydb
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+// a table exists once a commit to it has been made, and until it is dropped. dropping, truncating or renaming a
+// table waits for the merger, and for the table's committed segments to be written to disk, and fails with
+// TableInUse if the table has open transactions. the change is recorded in the write-ahead log before the manifest
+// is updated, so that commits to the table that are replayed from the log are discarded.
+
+// Tables returns the names of the tables in the database, in sorted order
+func (db *Database) Tables() ([]string, error) {
+	db.Lock()
+	defer db.Unlock()
+
+	if !db.open || db.closing {
+		return nil, DatabaseClosed
+	}
+
+	names := db.manifest.tableNames()
+	for name, it := range db.tables {
+		if !db.manifest.hasTable(name) && it.hasSegments() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// DropTable removes a table and all of its data from the database
+func (db *Database) DropTable(table string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	it, err := db.lockTableExclusive(table)
+	if err != nil {
+		return err
+	}
+	defer it.mergeLock.Unlock()
+	defer it.Unlock()
+
+	seq, err := db.log.appendTableRecord(logDropTable, table, "")
+	if err != nil {
+		return err
+	}
+	_, err = db.manifest.dropTable(table, false, seq)
+	if err != nil {
+		return err
+	}
+	delete(db.tables, table)
+	return removeSegments(it)
+}
+
+// TruncateTable removes all of the data from a table
+func (db *Database) TruncateTable(table string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	it, err := db.lockTableExclusive(table)
+	if err != nil {
+		return err
+	}
+	defer it.mergeLock.Unlock()
+	defer it.Unlock()
+
+	seq, err := db.log.appendTableRecord(logTruncateTable, table, "")
+	if err != nil {
+		return err
+	}
+	_, err = db.manifest.dropTable(table, true, seq)
+	if err != nil {
+		return err
+	}
+	return removeSegments(it)
+}
+
+// RenameTable changes the name of a table. there must not be a table with the new name, and the Comparators option
+// must have the same comparator for both names
+func (db *Database) RenameTable(from string, to string) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.options.comparator(from).Name() != db.options.comparator(to).Name() {
+		return ComparatorMismatch
+	}
+	if db.tableExists(to) {
+		return TableExists
+	}
+	if it, ok := db.tables[to]; ok && it.transactions > 0 {
+		return TableInUse
+	}
+
+	it, err := db.lockTableExclusive(from)
+	if err != nil {
+		return err
+	}
+	defer it.mergeLock.Unlock()
+	defer it.Unlock()
+
+	// the new name may have been used while waiting
+	if db.tableExists(to) {
+		return TableExists
+	}
+	if other, ok := db.tables[to]; ok && other.transactions > 0 {
+		return TableInUse
+	}
+
+	seq, err := db.log.appendTableRecord(logRenameTable, from, to)
+	if err != nil {
+		return err
+	}
+	err = db.manifest.renameTable(from, to, seq)
+	if err != nil {
+		return err
+	}
+	delete(db.tables, from)
+	it.name = to
+	db.tables[to] = it
+	return nil
+}
+
+// lockTableExclusive waits until the merger is not using the table, and the committed segments of the table are on
+// disk, returning the table with its merge lock and table lock held. the caller must hold the database lock, which is
+// released while waiting
+func (db *Database) lockTableExclusive(table string) (*internalTable, error) {
+	for {
+		if db.err != nil {
+			return nil, db.err
+		}
+		if !db.open || db.closing {
+			return nil, DatabaseClosed
+		}
+		if !db.tableExists(table) {
+			return nil, TableNotFound
+		}
+		it, err := db.getTable(table)
+		if err != nil {
+			return nil, err
+		}
+		if it.transactions > 0 {
+			return nil, TableInUse
+		}
+
+		// the merge lock is acquired without the database lock, as the merger may hold it for some time
+		db.Unlock()
+		it.mergeLock.Lock()
+		db.Lock()
+		it.Lock()
+
+		if db.tables[table] == it && it.transactions == 0 && !it.hasMemorySegments() {
+			return it, nil
+		}
+		busy := it.transactions > 0
+		it.Unlock()
+		it.mergeLock.Unlock()
+		if busy {
+			return nil, TableInUse
+		}
+
+		db.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		db.Lock()
+	}
+}
+
+// tableExists returns true if the table is in the manifest, or has commits that are not yet on disk. the caller
+// must hold the database lock
+func (db *Database) tableExists(table string) bool {
+	if db.manifest.hasTable(table) {
+		return true
+	}
+	it, ok := db.tables[table]
+	return ok && it.hasSegments()
+}
+
+func (table *internalTable) hasSegments() bool {
+	table.Lock()
+	defer table.Unlock()
+	return len(table.segments) > 0
+}
+
+// hasMemorySegments returns true if the table has committed segments that are not yet on disk. the caller must
+// hold the table lock
+func (table *internalTable) hasMemorySegments() bool {
+	for _, s := range table.segments {
+		if _, ok := s.(*diskSegment); !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSegments removes the disk segments of a dropped or truncated table. the files of each segment are removed
+// once no transaction or snapshot is using it. the caller must hold the table lock
+func removeSegments(table *internalTable) error {
+	var err error
+	for _, s := range table.segments {
+		if ds, ok := s.(*diskSegment); ok {
+			ds.obsolete = true
+			err = errn(err, ds.release())
+		}
+	}
+	table.segments = nil
+	return err
+}
+
+// replayTableRecord applies a table record read from the log to the manifest, when the database is opened. the
+// table segments are not loaded, so the files of dropped segments are removed directly
+func replayTableRecord(dbpath string, m *manifest, record logRecord) error {
+	switch record.recordType {
+	case logRenameTable:
+		return m.renameTable(record.table, record.to, record.seq)
+	default:
+		segments, err := m.dropTable(record.table, record.recordType == logTruncateTable, record.seq)
+		if err != nil {
+			return err
+		}
+		for _, ms := range segments {
+			keyFilename, dataFilename := segmentFilenames(dbpath, record.table, ms)
+			for _, filename := range []string{keyFilename, dataFilename} {
+				if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
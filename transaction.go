@@ -1,7 +1,6 @@
 package keydb
 
 import (
-	"errors"
 	"sync/atomic"
 	"time"
 )
@@ -16,6 +15,13 @@ type Transaction struct {
 	id     uint64
 	multi  *multiSegment
 	memory segment
+
+	// for serializable transactions, the last commit to the table before the transaction began, and the keys
+	// and ranges read by the transaction
+	serializable bool
+	startSeq     uint64
+	reads        map[string]bool
+	ranges       []keyRange
 }
 
 type transactionLookup struct {
@@ -42,6 +48,10 @@ func (tx *Transaction) GetID() uint64 {
 // a Transaction can only be used by a single Go routine.
 // each transaction should be completed with either Commit, or Rollback
 func (db *Database) BeginTX(table string) (*Transaction, error) {
+	return db.beginTX(table, false)
+}
+
+func (db *Database) beginTX(table string, serializable bool) (*Transaction, error) {
 	db.Lock()
 	defer db.Unlock()
 
@@ -53,14 +63,26 @@ func (db *Database) BeginTX(table string) (*Transaction, error) {
 		return nil, DatabaseClosed
 	}
 
-	it, ok := db.tables[table]
-	if !ok {
-		it = &internalTable{name: table, segments: loadDiskSegments(db.path, table)}
-		db.tables[table] = it
+	it, err := db.getTable(table)
+	if err != nil {
+		return nil, err
 	}
 
-	for { // wait to start transaction if table has too many segments
-		if len(it.segments) > maxSegments*10 {
+	db.stallWrites(it)
+
+	it.Lock()
+	defer it.Unlock()
+
+	return db.newTransaction(it, serializable), nil
+}
+
+// stallWrites waits to start a transaction if the table has too many segments. the caller must hold the database lock
+func (db *Database) stallWrites(it *internalTable) {
+	for {
+		it.Lock()
+		count := len(it.segments)
+		it.Unlock()
+		if count > db.options.WriteStallSegments {
 			db.Unlock()
 			time.Sleep(100 * time.Millisecond)
 			db.Lock()
@@ -68,21 +90,33 @@ func (db *Database) BeginTX(table string) (*Transaction, error) {
 			break
 		}
 	}
+}
 
-	it.Lock()
-	defer it.Unlock()
+// newTransaction creates a transaction for a table. the caller must hold the database and table locks
+func (db *Database) newTransaction(it *internalTable, serializable bool) *Transaction {
 	it.transactions++
 
-	tx := &Transaction{db: db, table: table, open: true}
+	tx := &Transaction{db: db, table: it.name, open: true}
 	tx.id = atomic.AddUint64(&txID, 1)
 
-	tx.memory = newMemorySegment()
+	if serializable {
+		it.beginSerializable(tx)
+	}
+
+	comparator := db.options.comparator(it.name)
+	tx.memory = newMemorySegmentWithComparator(comparator)
+
+	segments := make([]segment, len(it.segments), len(it.segments)+1)
+	copy(segments, it.segments)
+	acquireSegments(segments)
 
-	tx.multi = newMultiSegment(append(it.segments, tx.memory))
+	tx.multi = newMultiSegment(append(segments, tx.memory))
+	tx.multi.operator = db.options.MergeOperators[it.name]
+	tx.multi.comparator = comparator
 
 	db.transactions[tx.id] = tx
 
-	return tx, nil
+	return tx
 }
 
 // Get a value for a key, error is non-nil if the key was not found or an error occurred
@@ -90,9 +124,10 @@ func (tx *Transaction) Get(key []byte) (value []byte, err error) {
 	if !tx.open {
 		return nil, TransactionClosed
 	}
-	if len(key) > 1024 {
+	if len(key) > MaxKeyLength {
 		return nil, KeyTooLong
 	}
+	tx.readKey(key)
 	value, err = tx.multi.Get(key)
 	if err != nil {
 		return nil, err
@@ -108,7 +143,7 @@ func (tx *Transaction) Put(key []byte, value []byte) error {
 	if !tx.open {
 		return TransactionClosed
 	}
-	if len(key) > 1024 {
+	if len(key) > MaxKeyLength {
 		return KeyTooLong
 	}
 	if len(key) == 0 {
@@ -122,7 +157,7 @@ func (tx *Transaction) Remove(key []byte) ([]byte, error) {
 	if !tx.open {
 		return nil, TransactionClosed
 	}
-	if len(key) > 1024 {
+	if len(key) > MaxKeyLength {
 		return nil, KeyTooLong
 	}
 	value, err := tx.Get(key)
@@ -133,6 +168,45 @@ func (tx *Transaction) Remove(key []byte) ([]byte, error) {
 	return value, nil
 }
 
+// Delete a key and its value from the table. unlike Remove, the key is not read, so there is no error if the key does
+// not exist. empty keys are not supported.
+func (tx *Transaction) Delete(key []byte) error {
+	if !tx.open {
+		return TransactionClosed
+	}
+	if len(key) > MaxKeyLength {
+		return KeyTooLong
+	}
+	if len(key) == 0 {
+		return EmptyKey
+	}
+	tx.memory.Remove(key)
+	return nil
+}
+
+// Merge a merge operand into the value for a key, using the MergeOperator registered for the table with the
+// MergeOperators option. the existing value is not read, the operand is applied when the key is read, so the merges
+// made by concurrent transactions are all applied. empty keys are not supported.
+func (tx *Transaction) Merge(key []byte, operand []byte) error {
+	if !tx.open {
+		return TransactionClosed
+	}
+	if len(key) > MaxKeyLength {
+		return KeyTooLong
+	}
+	if len(key) == 0 {
+		return EmptyKey
+	}
+	if tx.multi.operator == nil {
+		return NoMergeOperator
+	}
+	if operand == nil {
+		// a nil value marks a removed key
+		operand = []byte{}
+	}
+	return tx.memory.Merge(key, operand, tx.multi.operator)
+}
+
 // Lookup finds matching record between lower and upper inclusive. lower or upper can be nil and
 // and then the range is unbounded on that side. Using the iterator after the transaction has
 // been Commit/Rollback is not supported.
@@ -140,6 +214,7 @@ func (tx *Transaction) Lookup(lower []byte, upper []byte) (LookupIterator, error
 	if !tx.open {
 		return nil, TransactionClosed
 	}
+	tx.readRange(lower, upper)
 	itr, err := tx.multi.Lookup(lower, upper)
 	if err != nil {
 		return nil, err
@@ -147,7 +222,24 @@ func (tx *Transaction) Lookup(lower []byte, upper []byte) (LookupIterator, error
 	return &transactionLookup{itr}, nil
 }
 
-// Commit persists any changes to the table. after Commit the transaction can no longer be used
+// LookupReverse finds matching records between lower and upper inclusive, like Lookup, but the
+// iterator returns them in descending key order
+func (tx *Transaction) LookupReverse(lower []byte, upper []byte) (LookupIterator, error) {
+	if !tx.open {
+		return nil, TransactionClosed
+	}
+	tx.readRange(lower, upper)
+	itr, err := tx.multi.LookupReverse(lower, upper)
+	if err != nil {
+		return nil, err
+	}
+	return &transactionLookup{itr}, nil
+}
+
+// Commit persists any changes to the table. the changes are recorded in the write-ahead log before Commit returns,
+// so they survive a process crash, but the log is only synced if the SyncCommits option is set. a serializable
+// transaction returns ErrConflict, and is not committed, if it conflicts with a concurrent commit. after Commit the
+// transaction can no longer be used
 func (tx *Transaction) Commit() error {
 	if !tx.open {
 		return TransactionClosed
@@ -158,29 +250,37 @@ func (tx *Transaction) Commit() error {
 	tx.open = false
 	tx.db.Unlock()
 
+	releaseSegments(tx.multi.segments)
+
 	table.Lock()
 	defer table.Unlock()
 
 	table.transactions--
-	table.segments = append(table.segments, tx.memory)
 
-	tx.db.wg.Add(1)
+	err := table.checkConflicts(tx)
+	table.endTransaction(tx)
+	if err != nil {
+		return err
+	}
 
-	go func() {
-		defer tx.db.wg.Done() // allows database to close with no writers pending
-		err := writeSegmentToDisk(tx.db, tx.table, tx.memory)
-		if err != nil {
-			tx.db.Lock()
-			tx.db.err = errors.New("transaction failed: " + err.Error())
-			tx.db.Unlock()
-		}
-	}()
+	tables := []logTable{{table: tx.table, memory: tx.memory}}
+
+	seq, err := tx.db.log.append(tables, tx.db.options.SyncCommits)
+	if err != nil {
+		return err
+	}
+
+	table.segments = append(table.segments, tx.memory)
+	table.committed(tx.memory)
+
+	writeSegmentsToDiskAsync(tx.db, seq, tables)
 
 	return nil
 }
 
-// CommitSync persists any changes to the table, waiting for disk segment to be written. note that synchronous writes are not used,
-// so that a hard OS failure could leave the database in a corrupted state. after Commit the transaction can no longer be used
+// CommitSync persists any changes to the table, waiting for disk segment to be written. the write-ahead log is
+// synced to stable storage before the segment is written, so the commit survives a hard OS failure.
+// after Commit the transaction can no longer be used
 func (tx *Transaction) CommitSync() error {
 	if !tx.open {
 		return TransactionClosed
@@ -194,6 +294,8 @@ func (tx *Transaction) CommitSync() error {
 
 	tx.db.Unlock()
 
+	releaseSegments(tx.multi.segments)
+
 	if err != nil {
 		return err
 	}
@@ -201,13 +303,30 @@ func (tx *Transaction) CommitSync() error {
 	table.Lock()
 
 	table.transactions--
+
+	err = table.checkConflicts(tx)
+	table.endTransaction(tx)
+	if err != nil {
+		table.Unlock()
+		return err
+	}
+
+	tables := []logTable{{table: tx.table, memory: tx.memory}}
+
+	seq, err := tx.db.log.append(tables, true)
+	if err != nil {
+		table.Unlock()
+		return err
+	}
+
 	table.segments = append(table.segments, tx.memory)
+	table.committed(tx.memory)
 
 	tx.db.wg.Add(1)
 
 	table.Unlock()
 
-	err = writeSegmentToDisk(tx.db, tx.table, tx.memory)
+	err = writeSegmentsToDisk(tx.db, seq, tables)
 	tx.db.wg.Done() // allows database to close with no writers pending
 
 	return err
@@ -224,6 +343,8 @@ func (tx *Transaction) Rollback() error {
 	table := tx.db.tables[tx.table]
 	table.Lock()
 
+	err := releaseSegments(tx.multi.segments)
+
 	tx.multi = nil
 	tx.open = false
 
@@ -231,6 +352,7 @@ func (tx *Transaction) Rollback() error {
 
 	defer table.Unlock()
 	table.transactions--
+	table.endTransaction(tx)
 
-	return nil
+	return err
 }
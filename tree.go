@@ -1,7 +1,6 @@
 package keydb
 
 import (
-	"bytes"
 	"fmt"
 )
 
@@ -9,6 +8,10 @@ import (
 // and range searching
 type Tree struct {
 	root *node
+	// the order of the keys, nil is bytewise
+	comparator Comparator
+	// incremented whenever the tree is changed, so that cursors know to reposition
+	version uint64
 }
 
 type node struct {
@@ -17,6 +20,8 @@ type node struct {
 	left  *node
 	right *node
 	h     int
+	// data is a merge operand rather than a value
+	operand bool
 }
 
 func (n *node) height() int {
@@ -30,22 +35,23 @@ func (n *node) balance() int {
 	return n.right.height() - n.left.height()
 }
 
-func (n *node) insert(key, data []byte) *node {
+func (n *node) insert(c Comparator, key, data []byte, operand bool) *node {
 
 	if n == nil {
-		return &node{key: key, data: data, h: 1}
+		return &node{key: key, data: data, h: 1, operand: operand}
 	}
 
-	if bytes.Equal(key, n.key) {
+	if equal(c, key, n.key) {
 		// node already exists nothing changes
 		n.data = data
+		n.operand = operand
 		return n
 	}
 
-	if less(key, n.key) {
-		n.left = n.left.insert(key, data)
+	if less(c, key, n.key) {
+		n.left = n.left.insert(c, key, data, operand)
 	} else {
-		n.right = n.right.insert(key, data)
+		n.right = n.right.insert(c, key, data, operand)
 	}
 
 	n.h = max(n.left.height(), n.right.height()) + 1
@@ -94,47 +100,63 @@ func (n *node) rotateRight() *node {
 	return l
 }
 
-func (n *node) Find(key []byte) ([]byte, bool) {
+func (n *node) Find(c Comparator, key []byte) ([]byte, bool) {
+	found := n.find(c, key)
+	if found == nil {
+		return nil, false
+	}
+	return found.data, true
+}
+
+func (n *node) find(c Comparator, key []byte) *node {
 
 	if n == nil {
-		return nil, false
+		return nil
 	}
 
-	if equal(key, n.key) {
-		return n.data, true
+	if equal(c, key, n.key) {
+		return n
 	}
 
-	if less(key, n.key) {
-		return n.left.Find(key)
+	if less(c, key, n.key) {
+		return n.left.find(c, key)
 	} else {
-		return n.right.Find(key)
+		return n.right.find(c, key)
 	}
 }
 
 // Remove does not actual remove the node, but instead stores a 'nil' Value. This is essential to allow the
 // memory index to track removals for other segments
-func (n *node) Remove(key []byte) ([]byte, bool) {
+func (n *node) Remove(c Comparator, key []byte) ([]byte, bool) {
 
 	if n == nil {
 		return nil, false
 	}
 
-	if bytes.Equal(key, n.key) {
+	if equal(c, key, n.key) {
 		prev := n.data
 		n.data = nil
+		n.operand = false
 		return prev, true
 	}
 
-	if less(key, n.key) {
-		return n.left.Remove(key)
+	if less(c, key, n.key) {
+		return n.left.Remove(c, key)
 	} else {
-		return n.right.Remove(key)
+		return n.right.Remove(c, key)
 	}
 }
 
 // Insert a key value pair into the Tree
 func (t *Tree) Insert(key, data []byte) {
-	t.root = t.root.insert(key, data)
+	t.root = t.root.insert(t.comparator, key, data, false)
+	t.version++
+}
+
+// insertOperand inserts a merge operand for a key into the Tree, replacing any existing value
+func (t *Tree) insertOperand(key, operand []byte) {
+	t.root = t.root.insert(t.comparator, key, operand, true)
+	t.version++
 }
 
 // Find the value for a given key, ok is true if the key was found
@@ -142,13 +164,13 @@ func (t *Tree) Find(key []byte) (value []byte, ok bool) {
 	if t.root == nil {
 		return nil, false
 	}
-	return t.root.Find(key)
+	return t.root.Find(t.comparator, key)
 }
 
 // Remove the value for a key, returning it. ok is true if the node existed and was found. If the key was not
 // found a 'nil' value is inserted into the tree
 func (t *Tree) Remove(key []byte) (value []byte, ok bool) {
-	old, ok := t.root.Remove(key)
+	old, ok := t.root.Remove(t.comparator, key)
 	if !ok {
 		t.Insert(key, nil)
 		return nil, false
@@ -163,8 +185,8 @@ type TreeEntry struct {
 	Value []byte
 }
 
-// FindNodes calls function fn on nodes with key between lower and upper inclusive
-func FindNodes(node *node, lower []byte, upper []byte, fn func(*node)) {
+// FindNodes calls function fn on nodes with key between lower and upper inclusive, using the comparator c
+func FindNodes(c Comparator, node *node, lower []byte, upper []byte, fn func(*node)) {
 	if node == nil {
 		return
 	}
@@ -172,18 +194,18 @@ func FindNodes(node *node, lower []byte, upper []byte, fn func(*node)) {
 	/* Since the desired o/p is sorted, recurse for left subtree first
 	   If node.key is greater than lower, then only we can get o/p keys
 	   in left subtree */
-	if lower == nil || less(lower, node.key) {
-		FindNodes(node.left, lower, upper, fn)
+	if lower == nil || less(c, lower, node.key) {
+		FindNodes(c, node.left, lower, upper, fn)
 	}
 
-	if isNodeInRange(node, lower, upper) {
+	if isNodeInRange(c, node, lower, upper) {
 		fn(node)
 	}
 
 	/* If node.key is smaller than upper, then only we can get o/p keys
 	in right subtree */
-	if upper == nil || less(node.key, upper) {
-		FindNodes(node.right, lower, upper, fn)
+	if upper == nil || less(c, node.key, upper) {
+		FindNodes(c, node.right, lower, upper, fn)
 	}
 }
 
@@ -198,18 +220,126 @@ func (t *Tree) FindNodes(lower []byte, upper []byte) []TreeEntry {
 	nodeInRange := func(n *node) {
 		results = append(results, TreeEntry{n.key, n.data})
 	}
-	FindNodes(t.root, lower, upper, nodeInRange)
+	FindNodes(t.comparator, t.root, lower, upper, nodeInRange)
 	return results
 }
 
-func isNodeInRange(n *node, lower []byte, upper []byte) bool {
+// treeCursor iterates the nodes of a tree in key order, between lower and upper inclusive, without copying them.
+// the cursor holds the path to the next node, so if the tree is changed, which may rebalance it, the cursor
+// repositions after the last node returned
+type treeCursor struct {
+	tree    *Tree
+	lower   []byte
+	upper   []byte
+	reverse bool
+	stack   []*node
+	version uint64
+	// the position of the cursor, which is the last key returned unless inclusive is true
+	position  []byte
+	inclusive bool
+}
+
+func newTreeCursor(tree *Tree, lower, upper []byte, reverse bool) *treeCursor {
+	c := &treeCursor{tree: tree, lower: lower, upper: upper, reverse: reverse}
+	c.seek(nil)
+	return c
+}
+
+// seek positions the cursor at the first node >= key, or the last node <= key if the cursor is reverse, within the
+// range of the cursor
+func (c *treeCursor) seek(key []byte) {
+	if c.reverse {
+		if key == nil || (c.upper != nil && less(c.tree.comparator, c.upper, key)) {
+			key = c.upper
+		}
+	} else {
+		if key == nil || (c.lower != nil && less(c.tree.comparator, key, c.lower)) {
+			key = c.lower
+		}
+	}
+	c.position = key
+	c.inclusive = true
+	c.reposition()
+}
+
+// reposition rebuilds the path to the next node from the position
+func (c *treeCursor) reposition() {
+	c.version = c.tree.version
+	c.stack = c.stack[:0]
+
+	key := c.position
+	n := c.tree.root
+	for n != nil {
+		var after bool
+		if key == nil {
+			after = true
+		} else if c.reverse {
+			after = less(c.tree.comparator, n.key, key) || (c.inclusive && equal(c.tree.comparator, n.key, key))
+		} else {
+			after = less(c.tree.comparator, key, n.key) || (c.inclusive && equal(c.tree.comparator, n.key, key))
+		}
+		if after {
+			c.stack = append(c.stack, n)
+			n = c.child(n, true)
+		} else {
+			n = c.child(n, false)
+		}
+	}
+}
+
+// child returns the child of the node towards the start of the iteration if first is true, otherwise the child
+// towards the end
+func (c *treeCursor) child(n *node, first bool) *node {
+	if first != c.reverse {
+		return n.left
+	}
+	return n.right
+}
+
+// peek returns the next node, or nil if there are no more nodes in range
+func (c *treeCursor) peek() *node {
+	if c.version != c.tree.version {
+		c.reposition()
+	}
+	if len(c.stack) == 0 {
+		return nil
+	}
+	n := c.stack[len(c.stack)-1]
+	if c.reverse {
+		if c.lower != nil && less(c.tree.comparator, n.key, c.lower) {
+			return nil
+		}
+	} else {
+		if c.upper != nil && less(c.tree.comparator, c.upper, n.key) {
+			return nil
+		}
+	}
+	return n
+}
+
+// next returns the next node and advances the cursor, or returns nil if there are no more nodes in range
+func (c *treeCursor) next() *node {
+	n := c.peek()
+	if n == nil {
+		return nil
+	}
+	c.stack = c.stack[:len(c.stack)-1]
+	for m := c.child(n, false); m != nil; m = c.child(m, true) {
+		c.stack = append(c.stack, m)
+	}
+	c.position = n.key
+	c.inclusive = false
+	return n
+}
+
+func isNodeInRange(c Comparator, n *node, lower []byte, upper []byte) bool {
 	if n == nil {
 		return false
 	}
-	if equal(n.key, lower) || equal(n.key, upper) {
+	if (lower != nil && equal(c, n.key, lower)) || (upper != nil && equal(c, n.key, upper)) {
 		return true
 	} else {
-		return (upper == nil || less(n.key, upper)) && (lower == nil || less(lower, n.key))
+		return (upper == nil || less(c, n.key, upper)) && (lower == nil || less(c, lower, n.key))
 	}
 }
 
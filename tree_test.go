@@ -48,3 +48,56 @@ func TestTree2(t *testing.T) {
 		log.Fatalln("height should be log2(150000) * phi, height is ", height)
 	}
 }
+
+func TestTreeCursor(t *testing.T) {
+	tree := &Tree{}
+	for i := 0; i < 1000; i += 2 {
+		tree.Insert([]byte(fmt.Sprintf("%04d", i)), []byte("value"))
+	}
+
+	lower, upper := []byte("0100"), []byte("0200")
+	nodes := tree.FindNodes(lower, upper)
+
+	c := newTreeCursor(tree, lower, upper, false)
+	for _, v := range nodes {
+		n := c.next()
+		if n == nil || string(n.key) != string(v.Key) {
+			t.Fatal("cursor does not match FindNodes", string(v.Key))
+		}
+	}
+	if c.next() != nil {
+		t.Fatal("cursor should be exhausted")
+	}
+
+	c = newTreeCursor(tree, lower, upper, true)
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := c.next()
+		if n == nil || string(n.key) != string(nodes[i].Key) {
+			t.Fatal("reverse cursor does not match FindNodes", string(nodes[i].Key))
+		}
+	}
+	if c.next() != nil {
+		t.Fatal("cursor should be exhausted")
+	}
+
+	// keys inserted during iteration are returned if they are after the cursor
+	c = newTreeCursor(tree, nil, nil, false)
+	var prev string
+	count := 0
+	for n := c.next(); n != nil; n = c.next() {
+		if string(n.key) <= prev {
+			t.Fatal("keys are out of order", prev, string(n.key))
+		}
+		prev = string(n.key)
+		count++
+		if count == 100 {
+			for i := 1; i < 1000; i += 2 {
+				tree.Insert([]byte(fmt.Sprintf("%04d", i)), []byte("value"))
+			}
+		}
+	}
+	// the first 100 keys are 0000 to 0198, followed by 0199 to 0999
+	if count != 100+801 {
+		t.Fatal("incorrect count", count)
+	}
+}
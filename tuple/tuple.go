@@ -0,0 +1,285 @@
+// Package tuple encodes tuples of values as keys whose byte order matches the order of the values, so that they can
+// be used with the default keydb.BytewiseComparator. tuples are ordered element by element, and a tuple sorts before
+// any longer tuple that starts with the same elements. elements of different types are ordered by type.
+//
+// the supported element types are nil, []byte, string, signed and unsigned integers, float32 and float64, time.Time,
+// and nested Tuples. integers are decoded as int64, or uint64 if the value does not fit in an int64, floats are decoded
+// as float64, and times are decoded in UTC.
+package tuple
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Tuple is an ordered list of elements, which can be packed into a key
+type Tuple []interface{}
+
+var UnsupportedType = errors.New("unsupported tuple element type")
+var InvalidTuple = errors.New("invalid packed tuple")
+
+// the type codes of the elements. integers are split into negative and non-negative codes, so that signed and
+// unsigned integers share an order
+const (
+	nilCode         byte = 0x00
+	bytesCode       byte = 0x01
+	stringCode      byte = 0x02
+	nestedCode      byte = 0x05
+	negativeIntCode byte = 0x14
+	intCode         byte = 0x15
+	floatCode       byte = 0x21
+	timeCode        byte = 0x30
+)
+
+// a 0x00 byte in a byte slice or string is escaped as 0x00 0xFF, so that 0x00 can terminate the element. nil in a
+// nested tuple is encoded the same way, so that it is not taken as the end of the tuple
+const terminator byte = 0x00
+const escape byte = 0xFF
+
+// Pack encodes the tuple as a key
+func (t Tuple) Pack() ([]byte, error) {
+	return t.pack(nil, false)
+}
+
+// Pack encodes the elements as a key, see Tuple.Pack
+func Pack(elements ...interface{}) ([]byte, error) {
+	return Tuple(elements).Pack()
+}
+
+func (t Tuple) pack(buf []byte, nested bool) ([]byte, error) {
+	var err error
+	for _, e := range t {
+		buf, err = packElement(buf, e, nested)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func packElement(buf []byte, e interface{}, nested bool) ([]byte, error) {
+	switch v := e.(type) {
+	case nil:
+		buf = append(buf, nilCode)
+		if nested {
+			buf = append(buf, escape)
+		}
+		return buf, nil
+	case []byte:
+		return packBytes(append(buf, bytesCode), v), nil
+	case string:
+		return packBytes(append(buf, stringCode), []byte(v)), nil
+	case int:
+		return packInt(buf, int64(v)), nil
+	case int8:
+		return packInt(buf, int64(v)), nil
+	case int16:
+		return packInt(buf, int64(v)), nil
+	case int32:
+		return packInt(buf, int64(v)), nil
+	case int64:
+		return packInt(buf, v), nil
+	case uint:
+		return packUint(buf, uint64(v)), nil
+	case uint8:
+		return packUint(buf, uint64(v)), nil
+	case uint16:
+		return packUint(buf, uint64(v)), nil
+	case uint32:
+		return packUint(buf, uint64(v)), nil
+	case uint64:
+		return packUint(buf, v), nil
+	case float32:
+		return packFloat(buf, float64(v)), nil
+	case float64:
+		return packFloat(buf, v), nil
+	case time.Time:
+		buf = append(buf, timeCode)
+		buf = appendUint64(buf, uint64(v.Unix())^(1<<63))
+		var nanos [4]byte
+		binary.BigEndian.PutUint32(nanos[:], uint32(v.Nanosecond()))
+		return append(buf, nanos[:]...), nil
+	case Tuple:
+		buf, err := v.pack(append(buf, nestedCode), true)
+		if err != nil {
+			return nil, err
+		}
+		return append(buf, terminator), nil
+	default:
+		return nil, fmt.Errorf("%w %T", UnsupportedType, e)
+	}
+}
+
+func packBytes(buf []byte, b []byte) []byte {
+	for _, c := range b {
+		buf = append(buf, c)
+		if c == terminator {
+			buf = append(buf, escape)
+		}
+	}
+	return append(buf, terminator)
+}
+
+// negative integers are stored offset by 2^63, so that they sort in order, before the non-negative integers
+func packInt(buf []byte, v int64) []byte {
+	if v < 0 {
+		return appendUint64(append(buf, negativeIntCode), uint64(v-math.MinInt64))
+	}
+	return packUint(buf, uint64(v))
+}
+
+func packUint(buf []byte, v uint64) []byte {
+	return appendUint64(append(buf, intCode), v)
+}
+
+// the sign bit of a positive float is set, and all of the bits of a negative float are flipped, so that the bits
+// sort in the order of the floats
+func packFloat(buf []byte, v float64) []byte {
+	bits := math.Float64bits(v)
+	if bits&(1<<63) != 0 {
+		bits = ^bits
+	} else {
+		bits |= 1 << 63
+	}
+	return appendUint64(append(buf, floatCode), bits)
+}
+
+func appendUint64(buf []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(buf, b[:]...)
+}
+
+// Unpack decodes a key created by Pack
+func Unpack(key []byte) (Tuple, error) {
+	t, rest, err := unpack(key, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, InvalidTuple
+	}
+	return t, nil
+}
+
+// unpack decodes elements until the end of the key, or for a nested tuple until its terminator, returning the
+// remainder of the key
+func unpack(key []byte, nested bool) (Tuple, []byte, error) {
+	t := Tuple{}
+	for len(key) > 0 {
+		code := key[0]
+		key = key[1:]
+
+		switch code {
+		case nilCode:
+			if !nested {
+				t = append(t, nil)
+				continue
+			}
+			if len(key) > 0 && key[0] == escape {
+				t = append(t, nil)
+				key = key[1:]
+				continue
+			}
+			return t, key, nil
+		case bytesCode, stringCode:
+			b, rest, err := unpackBytes(key)
+			if err != nil {
+				return nil, nil, err
+			}
+			key = rest
+			if code == stringCode {
+				t = append(t, string(b))
+			} else {
+				t = append(t, b)
+			}
+		case negativeIntCode, intCode:
+			if len(key) < 8 {
+				return nil, nil, InvalidTuple
+			}
+			v := binary.BigEndian.Uint64(key)
+			key = key[8:]
+			if code == negativeIntCode {
+				t = append(t, int64(v)+math.MinInt64)
+			} else if v > math.MaxInt64 {
+				t = append(t, v)
+			} else {
+				t = append(t, int64(v))
+			}
+		case floatCode:
+			if len(key) < 8 {
+				return nil, nil, InvalidTuple
+			}
+			bits := binary.BigEndian.Uint64(key)
+			key = key[8:]
+			if bits&(1<<63) != 0 {
+				bits &^= 1 << 63
+			} else {
+				bits = ^bits
+			}
+			t = append(t, math.Float64frombits(bits))
+		case timeCode:
+			if len(key) < 12 {
+				return nil, nil, InvalidTuple
+			}
+			seconds := int64(binary.BigEndian.Uint64(key) ^ (1 << 63))
+			nanos := int64(binary.BigEndian.Uint32(key[8:]))
+			key = key[12:]
+			t = append(t, time.Unix(seconds, nanos).UTC())
+		case nestedCode:
+			inner, rest, err := unpack(key, true)
+			if err != nil {
+				return nil, nil, err
+			}
+			key = rest
+			t = append(t, inner)
+		default:
+			return nil, nil, InvalidTuple
+		}
+	}
+	if nested {
+		// the terminator is missing
+		return nil, nil, InvalidTuple
+	}
+	return t, key, nil
+}
+
+func unpackBytes(key []byte) ([]byte, []byte, error) {
+	b := []byte{}
+	for i := 0; i < len(key); i++ {
+		if key[i] != terminator {
+			b = append(b, key[i])
+			continue
+		}
+		if i+1 < len(key) && key[i+1] == escape {
+			b = append(b, terminator)
+			i++
+			continue
+		}
+		return b, key[i+1:], nil
+	}
+	return nil, nil, InvalidTuple
+}
+
+// Range returns the lower and upper bounds, for Transaction.Lookup, of the keys of the tuples that start with the
+// elements of the tuple, including the tuple itself
+func (t Tuple) Range() (lower []byte, upper []byte, err error) {
+	prefix, err := t.Pack()
+	if err != nil {
+		return nil, nil, err
+	}
+	lower, upper = PrefixRange(prefix)
+	return lower, upper, nil
+}
+
+// PrefixRange returns the lower and upper bounds, for Transaction.Lookup, of the keys of the tuples that start with
+// a packed tuple. since every element starts with a type code below 0xFF, the prefix followed by 0xFF is after all of
+// the tuples that start with the prefix, and before any other tuple
+func PrefixRange(prefix []byte) (lower []byte, upper []byte) {
+	lower = append([]byte{}, prefix...)
+	upper = append(append([]byte{}, prefix...), 0xFF)
+	return lower, upper
+}
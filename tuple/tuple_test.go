@@ -0,0 +1,105 @@
+package tuple
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPackUnpack(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 6, time.UTC)
+	tuples := []Tuple{
+		{},
+		{nil},
+		{"mykey", []byte{0, 1, 0, 0xFF}, int64(-5), int64(7), uint64(math.MaxUint64), 1.5, now},
+		{"a\x00b", Tuple{nil, "nested", Tuple{}}, nil},
+	}
+	for _, tuple := range tuples {
+		key, err := tuple.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		unpacked, err := Unpack(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tuple, unpacked) {
+			t.Fatal("incorrect tuple", tuple, unpacked)
+		}
+	}
+
+	_, err := Pack(struct{}{})
+	if err == nil {
+		t.Fatal("unsupported type should not pack")
+	}
+	_, err = Unpack([]byte{stringCode, 'a'})
+	if err != InvalidTuple {
+		t.Fatal("missing terminator should not unpack", err)
+	}
+}
+
+func TestOrder(t *testing.T) {
+	// each group is in ascending order
+	groups := [][]interface{}{
+		{"", "a", "a\x00", "a\x00b", "a\x01", "b"},
+		{[]byte{}, []byte{0}, []byte{0, 0}, []byte{1}},
+		{int64(math.MinInt64), -1000, int8(-1), 0, uint8(1), 1000, int64(math.MaxInt64), uint64(math.MaxUint64)},
+		{math.Inf(-1), -2.5, -0.5, 0.0, float32(0.25), 2.5, math.Inf(1)},
+		{time.Unix(-100, 0), time.Unix(0, 0), time.Unix(0, 1), time.Unix(1e10, 0)},
+		{Tuple{}, Tuple{nil}, Tuple{nil, nil}, Tuple{"a"}, Tuple{"a", "b"}, Tuple{"b"}},
+	}
+	for _, group := range groups {
+		var prev []byte
+		for _, e := range group {
+			key, err := Pack(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if prev != nil && bytes.Compare(prev, key) >= 0 {
+				t.Fatal("element not in order", e)
+			}
+			prev = key
+		}
+	}
+
+	// shorter tuples sort before longer tuples with the same elements
+	var keys [][]byte
+	for _, tuple := range []Tuple{{"b"}, {"a", 2}, {"a"}, {"a", 1, "x"}, {"a", 1}} {
+		key, _ := tuple.Pack()
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	var sorted []Tuple
+	for _, key := range keys {
+		tuple, _ := Unpack(key)
+		sorted = append(sorted, tuple)
+	}
+	expected := []Tuple{{"a"}, {"a", int64(1)}, {"a", int64(1), "x"}, {"a", int64(2)}, {"b"}}
+	if !reflect.DeepEqual(sorted, expected) {
+		t.Fatal("incorrect order", sorted)
+	}
+}
+
+func TestRange(t *testing.T) {
+	lower, upper, err := Tuple{"a", 1}.Range()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inside := []Tuple{{"a", 1}, {"a", 1, nil}, {"a", 1, "z"}, {"a", 1, uint64(math.MaxUint64)}, {"a", 1, Tuple{"z"}}}
+	outside := []Tuple{{"a"}, {"a", 0, "z"}, {"a", 2}, {"a\x00"}, {"b"}}
+	for _, tuple := range inside {
+		key, _ := tuple.Pack()
+		if bytes.Compare(key, lower) < 0 || bytes.Compare(key, upper) > 0 {
+			t.Fatal("tuple should be in range", tuple)
+		}
+	}
+	for _, tuple := range outside {
+		key, _ := tuple.Pack()
+		if bytes.Compare(key, lower) >= 0 && bytes.Compare(key, upper) <= 0 {
+			t.Fatal("tuple should not be in range", tuple)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package keydb
+
+// TypedTable provides access to a database table using typed keys and values, which are converted to and from
+// bytes by codecs. errors from the codecs are returned as a *CodecError, so they can be distinguished from the
+// errors of the table, such as KeyNotFound
+type TypedTable[K any, V any] struct {
+	name   string
+	keys   Codec[K]
+	values Codec[V]
+}
+
+// NewTypedTable creates a TypedTable for a database table
+func NewTypedTable[K any, V any](table string, keys Codec[K], values Codec[V]) *TypedTable[K, V] {
+	return &TypedTable[K, V]{name: table, keys: keys, values: values}
+}
+
+// Name returns the name of the database table
+func (t *TypedTable[K, V]) Name() string {
+	return t.name
+}
+
+// BeginTX starts a transaction for the table, see Database.BeginTX
+func (t *TypedTable[K, V]) BeginTX(db *Database) (*Transaction, error) {
+	return db.BeginTX(t.name)
+}
+
+// check returns TableNotInTransaction if the transaction is for a different table
+func (t *TypedTable[K, V]) check(tx *Transaction) error {
+	if tx.table != t.name {
+		return TableNotInTransaction
+	}
+	return nil
+}
+
+func (t *TypedTable[K, V]) encodeKey(key K) ([]byte, error) {
+	data, err := t.keys.Encode(key)
+	if err != nil {
+		return nil, &CodecError{Op: "encode", Key: true, Err: err}
+	}
+	return data, nil
+}
+
+// Get the value for a key, error is non-nil if the key was not found or an error occurred
+func (t *TypedTable[K, V]) Get(tx *Transaction, key K) (V, error) {
+	var value V
+	err := t.check(tx)
+	if err != nil {
+		return value, err
+	}
+	k, err := t.encodeKey(key)
+	if err != nil {
+		return value, err
+	}
+	data, err := tx.Get(k)
+	if err != nil {
+		return value, err
+	}
+	value, err = t.values.Decode(data)
+	if err != nil {
+		return value, &CodecError{Op: "decode", Err: err}
+	}
+	return value, nil
+}
+
+// Put a key/value pair into the table, overwriting any existing entry
+func (t *TypedTable[K, V]) Put(tx *Transaction, key K, value V) error {
+	err := t.check(tx)
+	if err != nil {
+		return err
+	}
+	k, err := t.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	data, err := t.values.Encode(value)
+	if err != nil {
+		return &CodecError{Op: "encode", Err: err}
+	}
+	return tx.Put(k, data)
+}
+
+// Delete a key and its value from the table, see Transaction.Delete
+func (t *TypedTable[K, V]) Delete(tx *Transaction, key K) error {
+	err := t.check(tx)
+	if err != nil {
+		return err
+	}
+	k, err := t.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return tx.Delete(k)
+}
+
+// Lookup finds the records between lower and upper inclusive, see Transaction.Lookup. a nil lower or upper is
+// unbounded on that side
+func (t *TypedTable[K, V]) Lookup(tx *Transaction, lower *K, upper *K) (*TypedIterator[K, V], error) {
+	return t.lookup(tx, lower, upper, false)
+}
+
+// LookupReverse finds the records between lower and upper inclusive in descending key order, see
+// Transaction.LookupReverse
+func (t *TypedTable[K, V]) LookupReverse(tx *Transaction, lower *K, upper *K) (*TypedIterator[K, V], error) {
+	return t.lookup(tx, lower, upper, true)
+}
+
+func (t *TypedTable[K, V]) lookup(tx *Transaction, lower *K, upper *K, reverse bool) (*TypedIterator[K, V], error) {
+	err := t.check(tx)
+	if err != nil {
+		return nil, err
+	}
+	var l, u []byte
+	if lower != nil {
+		l, err = t.encodeKey(*lower)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if upper != nil {
+		u, err = t.encodeKey(*upper)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var itr LookupIterator
+	if reverse {
+		itr, err = tx.LookupReverse(l, u)
+	} else {
+		itr, err = tx.Lookup(l, u)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &TypedIterator[K, V]{table: t, itr: itr}, nil
+}
+
+// TypedIterator iterates the records of a TypedTable
+type TypedIterator[K any, V any] struct {
+	table *TypedTable[K, V]
+	itr   LookupIterator
+}
+
+// Next returns the next record, err is EndOfIterator when complete
+func (ti *TypedIterator[K, V]) Next() (key K, value V, err error) {
+	k, v, err := ti.itr.Next()
+	if err != nil {
+		return key, value, err
+	}
+	key, err = ti.table.keys.Decode(k)
+	if err != nil {
+		return key, value, &CodecError{Op: "decode", Key: true, Err: err}
+	}
+	value, err = ti.table.values.Decode(v)
+	if err != nil {
+		return key, value, &CodecError{Op: "decode", Err: err}
+	}
+	return key, value, nil
+}
+
+// Seek repositions the iterator, see LookupIterator.Seek
+func (ti *TypedIterator[K, V]) Seek(key K) error {
+	k, err := ti.table.encodeKey(key)
+	if err != nil {
+		return err
+	}
+	return ti.itr.Seek(k)
+}
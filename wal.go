@@ -0,0 +1,548 @@
+package keydb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// the write-ahead log records the committed memory segments of every transaction before the
+// commit returns, so that a commit is not lost if the process terminates before the segments are
+// written to disk. the log is replayed by Open, and truncated whenever all logged segments have
+// been written to disk. the records before the oldest commit that is not on disk are no longer
+// needed, so once they reach logCompactSize bytes the log is rewritten without them, and the log
+// does not grow under a steady load of commits.
+//
+// every record has a sequence number. the disk segments of the commits are recorded in the manifest in the
+// order the commits were logged, along with the sequence number of the last one, so the commits at or below
+// it are not replayed, as replaying a merge operand that is already on disk would apply it twice. the manifest
+// also records the sequence number of the last table record it applied.
+//
+// each record in the log is
+// payloadlen uint32
+// checksum uint32 (crc32c of the payload)
+// payloadlen uint64 (only if the uint32 payloadlen is largeRecord, for payloads of 4GB or more)
+// payload []byte
+//
+// the payload of every record starts with
+// record type byte
+// sequence uint64
+//
+// the payload of a commit record then has one or more table sections
+// tablelen uint16
+// table []byte
+// entries, each being
+// entry type byte (entryEnd marks the end of the section)
+// keylen uvarint
+// key []byte
+// datalen uvarint (only if entry type is entryValue or entryOperand)
+// data []byte
+//
+// a deleted range is an entry of type entryDeleteRange, with the lower bound as the key and the upper bound as the
+// data, where an empty bound is unbounded. the deleted ranges precede the keys of the section, since the keys in
+// the memory segment are the ones that remain after the ranges were deleted
+//
+// the payload of a table record, which drops, truncates or renames a table, then has
+// tablelen uint16
+// table []byte
+// and for a rename the new name
+// tablelen uint16
+// table []byte
+//
+// a torn or corrupt record ends the replay, since the commit it belongs to never returned
+//
+
+const logFilename = "wal"
+
+const logCompactSize = 1024 * 1024
+
+const largeRecord = 0xFFFFFFFF
+
+const (
+	logCommit        byte = 1
+	logDropTable     byte = 2
+	logTruncateTable byte = 3
+	logRenameTable   byte = 4
+)
+
+const (
+	entryEnd         byte = 0
+	entryValue       byte = 1
+	entryRemoved     byte = 2
+	entryDeleteRange byte = 3
+	entryOperand     byte = 4
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var errCorruptLog = errors.New("corrupt log record")
+
+type writeAheadLog struct {
+	sync.Mutex
+	file     *os.File
+	filename string
+	size     int64
+	// the sequence number of the last record
+	seq uint64
+	// the logged commits whose segments are not recorded in the manifest, in the order they were logged
+	pending []logPosition
+	// signalled when a commit is flushed
+	flushing *sync.Cond
+	// the error writing the segments of a commit to disk, once set the later commits can not be flushed
+	err error
+}
+
+// logPosition is the sequence number and offset in the log of a commit record
+type logPosition struct {
+	seq    uint64
+	offset int64
+}
+
+// logTable is a table section of a log record, holding the memory segment committed to the table
+type logTable struct {
+	table  string
+	memory segment
+}
+
+// logRecord is a record read from the log. a commit record has the tables of the commit, a table record has
+// the table name, and the new name if it is a rename
+type logRecord struct {
+	recordType byte
+	seq        uint64
+	offset     int64
+	tables     []logTable
+	table      string
+	to         string
+}
+
+// openLog opens the log, returning the commits that must be replayed, with the memory segments using the
+// comparators in the options. any torn record at the end of the log is discarded
+func openLog(filename string, options Options) (*writeAheadLog, []logRecord, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	records, valid := readLog(file, options)
+
+	err = file.Truncate(valid)
+	if err == nil {
+		_, err = file.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	log := &writeAheadLog{file: file, filename: filename, size: valid}
+	log.flushing = sync.NewCond(log)
+	if len(records) > 0 {
+		log.seq = records[len(records)-1].seq
+	}
+	return log, records, nil
+}
+
+// readLog reads all of the valid records in the log, returning them along with the length of
+// the log that contains valid records
+func readLog(file *os.File, options Options) ([]logRecord, int64) {
+	r := bufio.NewReader(file)
+
+	var length int64
+	if fi, err := file.Stat(); err == nil {
+		length = fi.Size()
+	}
+
+	var records []logRecord
+	var valid int64
+	var header [8]byte
+
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err != nil {
+			break
+		}
+		headerlen := int64(len(header))
+		payloadlen := int64(binary.LittleEndian.Uint32(header[:]))
+		if payloadlen == largeRecord {
+			var large [8]byte
+			_, err = io.ReadFull(r, large[:])
+			if err != nil {
+				break
+			}
+			headerlen += int64(len(large))
+			payloadlen = int64(binary.LittleEndian.Uint64(large[:]))
+		}
+		if payloadlen < 0 || valid+headerlen+payloadlen > length {
+			break
+		}
+		payload := make([]byte, payloadlen)
+		_, err = io.ReadFull(r, payload)
+		if err != nil {
+			break
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(header[4:]) {
+			break
+		}
+		record, err := decodeLogRecord(payload, options)
+		if err != nil {
+			break
+		}
+		record.offset = valid
+		records = append(records, record)
+		valid += headerlen + payloadlen
+	}
+	return records, valid
+}
+
+func decodeLogRecord(payload []byte, options Options) (logRecord, error) {
+	r := bytes.NewReader(payload)
+
+	recordType, err := r.ReadByte()
+	if err != nil {
+		return logRecord{}, errCorruptLog
+	}
+	var seq uint64
+	err = binary.Read(r, binary.LittleEndian, &seq)
+	if err != nil {
+		return logRecord{}, errCorruptLog
+	}
+
+	switch recordType {
+	case logCommit:
+		tables, err := decodeCommit(r, options)
+		return logRecord{recordType: recordType, seq: seq, tables: tables}, err
+	case logDropTable, logTruncateTable, logRenameTable:
+		record := logRecord{recordType: recordType, seq: seq}
+		record.table, err = readLogTableName(r)
+		if err == nil && recordType == logRenameTable {
+			record.to, err = readLogTableName(r)
+		}
+		if err == nil && r.Len() != 0 {
+			err = errCorruptLog
+		}
+		return record, err
+	default:
+		return logRecord{}, errCorruptLog
+	}
+}
+
+func readLogTableName(r *bytes.Reader) (string, error) {
+	var tablelen uint16
+	err := binary.Read(r, binary.LittleEndian, &tablelen)
+	if err != nil {
+		return "", errCorruptLog
+	}
+	table := make([]byte, tablelen)
+	_, err = io.ReadFull(r, table)
+	if err != nil {
+		return "", errCorruptLog
+	}
+	return string(table), nil
+}
+
+func decodeCommit(r *bytes.Reader, options Options) ([]logTable, error) {
+	var tables []logTable
+
+	for r.Len() > 0 {
+		table, err := readLogTableName(r)
+		if err != nil {
+			return nil, err
+		}
+		ms := newMemorySegmentWithComparator(options.comparator(table)).(*memorySegment)
+		for {
+			entryType, err := r.ReadByte()
+			if err != nil {
+				return nil, errCorruptLog
+			}
+			if entryType == entryEnd {
+				break
+			}
+			key, err := readLogBytes(r)
+			if err != nil {
+				return nil, err
+			}
+			switch entryType {
+			case entryValue:
+				value, err := readLogBytes(r)
+				if err != nil {
+					return nil, err
+				}
+				ms.Put(key, value)
+			case entryOperand:
+				operand, err := readLogBytes(r)
+				if err != nil {
+					return nil, err
+				}
+				ms.tree.insertOperand(key, operand)
+			case entryRemoved:
+				ms.Remove(key)
+			case entryDeleteRange:
+				upper, err := readLogBytes(r)
+				if err != nil {
+					return nil, err
+				}
+				ms.DeleteRange(nonEmpty(key), nonEmpty(upper))
+			default:
+				return nil, errCorruptLog
+			}
+		}
+		tables = append(tables, logTable{table: table, memory: ms})
+	}
+	return tables, nil
+}
+
+func readLogBytes(r *bytes.Reader) ([]byte, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil || length > uint64(r.Len()) {
+		return nil, errCorruptLog
+	}
+	buffer := make([]byte, length)
+	_, err = io.ReadFull(r, buffer)
+	if err != nil {
+		return nil, errCorruptLog
+	}
+	return buffer, nil
+}
+
+// encodeLogRecord returns the payload of a commit record, the sequence number is set when it is written
+func encodeLogRecord(tables []logTable) ([]byte, error) {
+	var buf bytes.Buffer
+	var lenbuf [binary.MaxVarintLen64]byte
+
+	writeBytes := func(b []byte) {
+		n := binary.PutUvarint(lenbuf[:], uint64(len(b)))
+		buf.Write(lenbuf[:n])
+		buf.Write(b)
+	}
+
+	buf.WriteByte(logCommit)
+	binary.Write(&buf, binary.LittleEndian, uint64(0))
+
+	for _, lt := range tables {
+		binary.Write(&buf, binary.LittleEndian, uint16(len(lt.table)))
+		buf.WriteString(lt.table)
+
+		for _, r := range lt.memory.deletedRanges() {
+			buf.WriteByte(entryDeleteRange)
+			writeBytes(r.lower)
+			writeBytes(r.upper)
+		}
+
+		itr, err := lt.memory.Lookup(nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			key, value, operand, err := nextRecord(itr)
+			if err == EndOfIterator {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if operand {
+				buf.WriteByte(entryOperand)
+				writeBytes(key)
+				writeBytes(value)
+			} else if value == nil {
+				buf.WriteByte(entryRemoved)
+				writeBytes(key)
+			} else {
+				buf.WriteByte(entryValue)
+				writeBytes(key)
+				writeBytes(value)
+			}
+		}
+		buf.WriteByte(entryEnd)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// append writes the memory segments for a committed transaction to the log as a single record, so
+// that they are replayed together, returning the sequence number of the record. if sync is true the log is
+// flushed to stable storage before returning
+func (log *writeAheadLog) append(tables []logTable, sync bool) (uint64, error) {
+	payload, err := encodeLogRecord(tables)
+	if err != nil {
+		return 0, err
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	offset := log.size
+	seq, err := log.write(payload, sync)
+	if err != nil {
+		return 0, err
+	}
+	log.pending = append(log.pending, logPosition{seq: seq, offset: offset})
+	return seq, nil
+}
+
+// appendTableRecord writes a record that drops, truncates or renames a table to the log, syncing it to stable
+// storage, and returns the sequence number of the record. to is only used by a rename
+func (log *writeAheadLog) appendTableRecord(recordType byte, table string, to string) (uint64, error) {
+	var buf bytes.Buffer
+	buf.WriteByte(recordType)
+	binary.Write(&buf, binary.LittleEndian, uint64(0))
+	binary.Write(&buf, binary.LittleEndian, uint16(len(table)))
+	buf.WriteString(table)
+	if recordType == logRenameTable {
+		binary.Write(&buf, binary.LittleEndian, uint16(len(to)))
+		buf.WriteString(to)
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	return log.write(buf.Bytes(), true)
+}
+
+// write appends a record with the payload to the log, setting its sequence number, which is returned. the caller
+// must hold the log lock
+func (log *writeAheadLog) write(payload []byte, sync bool) (uint64, error) {
+	seq := log.seq + 1
+	binary.LittleEndian.PutUint64(payload[1:], seq)
+
+	headerlen := 8
+	if len(payload) >= largeRecord {
+		headerlen += 8
+	}
+	record := make([]byte, headerlen+len(payload))
+	if headerlen > 8 {
+		binary.LittleEndian.PutUint32(record, largeRecord)
+		binary.LittleEndian.PutUint64(record[8:], uint64(len(payload)))
+	} else {
+		binary.LittleEndian.PutUint32(record, uint32(len(payload)))
+	}
+	binary.LittleEndian.PutUint32(record[4:], crc32.Checksum(payload, crcTable))
+	copy(record[headerlen:], payload)
+
+	_, err := log.file.Write(record)
+	if err == nil && sync {
+		err = log.file.Sync()
+	}
+	if err != nil {
+		// discard any partial record so that later records can be replayed
+		log.file.Truncate(log.size)
+		log.file.Seek(log.size, io.SeekStart)
+		return 0, err
+	}
+	log.size += int64(len(record))
+	log.seq = seq
+	return seq, nil
+}
+
+// replayed notes that a commit read from the log has not yet been written to disk. the commits are replayed in
+// the order they were logged, before any new commit
+func (log *writeAheadLog) replayed(record logRecord) {
+	log.Lock()
+	defer log.Unlock()
+	log.pending = append(log.pending, logPosition{seq: record.seq, offset: record.offset})
+}
+
+// waitFlush waits until the commits logged before the commit with the sequence number have been flushed, so that
+// the manifest records the disk segments in the order of the commits
+func (log *writeAheadLog) waitFlush(seq uint64) error {
+	log.Lock()
+	defer log.Unlock()
+
+	for log.err == nil && log.pending[0].seq != seq {
+		log.flushing.Wait()
+	}
+	return log.err
+}
+
+// failed is called when the segments of a commit can not be written to disk. the commits logged after it are
+// not flushed, so they remain in the log
+func (log *writeAheadLog) failed(err error) {
+	log.Lock()
+	defer log.Unlock()
+
+	if log.err == nil {
+		log.err = err
+	}
+	log.flushing.Broadcast()
+}
+
+// flushed is called when the disk segments of the oldest pending commit are recorded in the manifest. once every
+// logged commit is on disk the log is no longer needed, so it is truncated, otherwise the records before the oldest
+// pending commit are removed once they reach logCompactSize
+func (log *writeAheadLog) flushed() error {
+	log.Lock()
+	defer log.Unlock()
+
+	log.pending = log.pending[1:]
+	log.flushing.Broadcast()
+	if len(log.pending) > 0 {
+		if log.pending[0].offset >= logCompactSize {
+			return log.compact(log.pending[0].offset)
+		}
+		return nil
+	}
+	err := log.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = log.file.Seek(0, io.SeekStart)
+	log.size = 0
+	return err
+}
+
+// compact rewrites the log without the records before the offset. the remaining records are copied
+// to a new log, which replaces the log once it is on stable storage. the caller must hold the log lock
+func (log *writeAheadLog) compact(offset int64) error {
+	tail := make([]byte, log.size-offset)
+	_, err := log.file.ReadAt(tail, offset)
+	if err != nil {
+		return err
+	}
+
+	tmp := log.filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(tail)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, log.filename)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	log.file.Close()
+	log.file = f
+	log.size -= offset
+	for i := range log.pending {
+		log.pending[i].offset -= offset
+	}
+	return syncDir(filepath.Dir(log.filename))
+}
+
+func (log *writeAheadLog) close() error {
+	log.Lock()
+	defer log.Unlock()
+	return log.file.Close()
+}
+
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	return errn(err, dir.Close())
+}
@@ -0,0 +1,335 @@
+package keydb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLogReplay(t *testing.T) {
+	os.RemoveAll("test")
+	os.MkdirAll("test/mydb", os.ModePerm)
+
+	// simulate a process that terminated after the commit was logged, but before the segment was written
+	log, records, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatal("log should be empty")
+	}
+	m := newMemorySegment()
+	m.Put([]byte("mykey"), []byte("myvalue"))
+	m.Put([]byte("mykey2"), []byte("myvalue2"))
+	m.Remove([]byte("mykey3"))
+	_, err = log.append([]logTable{{table: "main", memory: m}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.close()
+
+	// a torn record at the end of the log is ignored
+	f, _ := os.OpenFile(filepath.Join("test/mydb", logFilename), os.O_APPEND|os.O_WRONLY, os.ModePerm)
+	f.Write([]byte{100, 0, 0, 0, 1, 2})
+	f.Close()
+
+	db, err := Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	value, err := tx.Get([]byte("mykey2"))
+	if err != nil || string(value) != "myvalue2" {
+		t.Fatal("commit was not replayed", err)
+	}
+	_, err = tx.Get([]byte("mykey3"))
+	if err != KeyNotFound {
+		t.Fatal("removed key should not be found", err)
+	}
+	tx.Commit()
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	fi, err := os.Stat(filepath.Join("test/mydb", logFilename))
+	if err != nil || fi.Size() != 0 {
+		t.Fatal("log should be empty after close", err)
+	}
+
+	db, err = Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tx, err = db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	value, err = tx.Get([]byte("mykey"))
+	if err != nil || string(value) != "myvalue" {
+		t.Fatal("replayed commit was not persisted", err)
+	}
+	tx.Commit()
+	db.Close()
+}
+
+func TestLogCompaction(t *testing.T) {
+	os.RemoveAll("test")
+	os.MkdirAll("test/mydb", os.ModePerm)
+	filename := filepath.Join("test/mydb", logFilename)
+
+	log, _, err := openLog(filename, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := newMemorySegment()
+	large.Put([]byte("large"), make([]byte, logCompactSize))
+	seq, err := log.append([]logTable{{table: "main", memory: large}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemorySegment()
+	m.Put([]byte("mykey"), []byte("myvalue"))
+	_, err = log.append([]logTable{{table: "main", memory: m}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the log is compacted while a later commit is pending, rather than waiting for every commit to be flushed
+	err = log.waitFlush(seq)
+	if err == nil {
+		err = log.flushed()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = log.append([]logTable{{table: "other", memory: m}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.close()
+
+	fi, err := os.Stat(filename)
+	if err != nil || fi.Size() >= logCompactSize {
+		t.Fatal("flushed commit should be removed from the log", err)
+	}
+	log, records, err := openLog(filename, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	if len(records) != 2 || records[0].seq != seq+1 || records[1].seq != seq+2 || records[1].tables[0].table != "other" {
+		t.Fatal("pending commits should remain in the log", records)
+	}
+}
+
+func TestLogReplayFlushed(t *testing.T) {
+	os.RemoveAll("test")
+	os.MkdirAll("test/mydb", os.ModePerm)
+
+	log, _, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemorySegment()
+	m.Merge([]byte("mykey"), []byte("1"), AppendOperator)
+	_, err = log.append([]logTable{{table: "main", memory: m}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.close()
+	logged, err := ioutil.ReadFile(filepath.Join("test/mydb", logFilename))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := Options{MergeOperators: map[string]MergeOperator{"main": AppendOperator}}
+	db, err := OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal("unable to close database", err)
+	}
+
+	// simulate a process that terminated after the segment was written, but before the log was truncated
+	err = ioutil.WriteFile(filepath.Join("test/mydb", logFilename), logged, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithOptions("test/mydb", options)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	defer db.Close()
+	tx, err := db.BeginTX("main")
+	if err != nil {
+		t.Fatal("unable to create transaction", err)
+	}
+	defer tx.Rollback()
+	value, err := tx.Get([]byte("mykey"))
+	if err != nil || string(value) != "1" {
+		t.Fatal("operand on disk should not be replayed", string(value), err)
+	}
+}
+
+func TestLogReplayMultipleTables(t *testing.T) {
+	os.RemoveAll("test")
+	os.MkdirAll("test/mydb", os.ModePerm)
+
+	log, _, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m1 := newMemorySegment()
+	m1.Put([]byte("mykey"), []byte("myvalue"))
+	m2 := newMemorySegment()
+	m2.Put([]byte("myvalue"), []byte("mykey"))
+	_, err = log.append([]logTable{{table: "main", memory: m1}, {table: "index", memory: m2}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.close()
+
+	log, records, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	if len(records) != 1 || len(records[0].tables) != 2 {
+		t.Fatal("both tables should be replayed as a single record", records)
+	}
+	if records[0].tables[1].table != "index" {
+		t.Fatal("incorrect table", records[0].tables[1].table)
+	}
+	value, err := records[0].tables[1].memory.Get([]byte("myvalue"))
+	if err != nil || string(value) != "mykey" {
+		t.Fatal("incorrect value", err)
+	}
+}
+
+func TestLogReplayTableRecords(t *testing.T) {
+	os.RemoveAll("test")
+	os.MkdirAll("test/mydb", os.ModePerm)
+
+	// a commit to a table that is later dropped is not replayed, and the table is removed
+	log, _, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"main", "other"} {
+		m := newMemorySegment()
+		m.Put([]byte("mykey"), []byte(table))
+		_, err = log.append([]logTable{{table: table, memory: m}}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = log.appendTableRecord(logDropTable, "main", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = log.appendTableRecord(logRenameTable, "other", "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemorySegment()
+	m.Put([]byte("mykey2"), []byte("renamed"))
+	log.append([]logTable{{table: "renamed", memory: m}}, true)
+	log.close()
+
+	db, err := Open("test/mydb", false)
+	if err != nil {
+		t.Fatal("unable to open database", err)
+	}
+	tables, _ := db.Tables()
+	if len(tables) != 1 || tables[0] != "renamed" {
+		t.Fatal("incorrect tables", tables)
+	}
+	tx, _ := db.BeginTX("renamed")
+	_, err = tx.Get([]byte("mykey"))
+	if err != KeyNotFound {
+		t.Fatal("commit before the rename should be discarded", err)
+	}
+	value, err := tx.Get([]byte("mykey2"))
+	if err != nil || string(value) != "renamed" {
+		t.Fatal("commit after the rename should be replayed", err)
+	}
+	tx.Rollback()
+	db.Close()
+}
+
+func TestLogReplayDeleteRange(t *testing.T) {
+	os.RemoveAll("test")
+	os.MkdirAll("test/mydb", os.ModePerm)
+
+	log, _, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemorySegment()
+	m.Put([]byte("mykey1"), []byte("myvalue"))
+	m.DeleteRange([]byte("mykey1"), nil)
+	m.Put([]byte("mykey2"), []byte("myvalue"))
+	_, err = log.append([]logTable{{table: "main", memory: m}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.close()
+
+	log, records, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	if len(records) != 1 {
+		t.Fatal("incorrect records", records)
+	}
+	replayed := records[0].tables[0].memory
+	deleted := replayed.deletedRanges()
+	if len(deleted) != 1 || string(deleted[0].lower) != "mykey1" || deleted[0].upper != nil {
+		t.Fatal("incorrect deleted ranges", deleted)
+	}
+	value, err := replayed.Get([]byte("mykey1"))
+	if err != nil || value != nil {
+		t.Fatal("key should be removed", value, err)
+	}
+	value, err = replayed.Get([]byte("mykey2"))
+	if err != nil || string(value) != "myvalue" {
+		t.Fatal("key written after the range should remain", value, err)
+	}
+}
+
+func TestLogReplayOperands(t *testing.T) {
+	os.RemoveAll("test")
+	os.MkdirAll("test/mydb", os.ModePerm)
+
+	log, _, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMemorySegment()
+	m.Merge([]byte("mykey"), []byte("myvalue"), AppendOperator)
+	_, err = log.append([]logTable{{table: "main", memory: m}}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.close()
+
+	log, records, err := openLog(filepath.Join("test/mydb", logFilename), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.close()
+	value, err := records[0].tables[0].memory.Get([]byte("mykey"))
+	if err != errMergeOperand || string(value) != "myvalue" {
+		t.Fatal("operand should be replayed", string(value), err)
+	}
+}